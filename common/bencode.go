@@ -0,0 +1,119 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/marksamman/bencode"
+)
+
+// 列表和字典的最大嵌套层数
+const maxBencodeDepth = 32
+
+var ErrInvalidBencode = errors.New("invalid bencode")
+
+// DecodeDict 先检查b的结构再用bencode库解码, 用于解析对方发来的不可信数据
+// bencode库按字符串声明的长度分配内存, 几十字节的数据就能让它分配几G内存, 这里先确认长度不超过剩余数据
+// 只解码开头的一个值, 之后的数据被忽略
+func DecodeDict(b []byte) (map[string]interface{}, error) {
+	n, err := valueLen(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	return bencode.Decode(bytes.NewReader(b[:n]))
+}
+
+// DecodeValue 解码r当前位置的一个bencode值, 返回值和它占用的字节数, r停在这个值之后
+// 用于bencode之后紧跟原始数据的消息, 如ut_metadata的data消息
+func DecodeValue(r *bytes.Reader) (interface{}, int, error) {
+	start, _ := r.Seek(0, io.SeekCurrent)
+	b := make([]byte, r.Len())
+	r.Read(b)
+	n, err := valueLen(b, 0)
+	if err != nil {
+		r.Seek(start, io.SeekStart)
+		return nil, 0, err
+	}
+	r.Seek(start+int64(n), io.SeekStart)
+
+	//bencode库只能解码字典, 把值包在字典中解码
+	wrapped := make([]byte, 0, n+5)
+	wrapped = append(wrapped, "d1:v"...)
+	wrapped = append(wrapped, b[:n]...)
+	wrapped = append(wrapped, 'e')
+	dict, err := bencode.Decode(bytes.NewReader(wrapped))
+	if err != nil {
+		return nil, 0, err
+	}
+	return dict["v"], n, nil
+}
+
+// RawDictValue 返回字典b中key对应的值的原始bencode字节, 不存在时返回nil
+// 用于取.torrent文件中的info字典计算infohash, 解码后重新编码可能与原始字节不同
+func RawDictValue(b []byte, key string) ([]byte, error) {
+	if _, err := valueLen(b, 0); err != nil {
+		return nil, err
+	}
+	if b[0] != 'd' {
+		return nil, ErrInvalidBencode
+	}
+	i := 1
+	for b[i] != 'e' {
+		if b[i] < '0' || b[i] > '9' {
+			return nil, ErrInvalidBencode
+		}
+		n, _ := valueLen(b[i:], 1)
+		k := b[i+bytes.IndexByte(b[i:], ':')+1 : i+n]
+		i += n
+		n, err := valueLen(b[i:], 1)
+		if err != nil {
+			return nil, ErrInvalidBencode
+		}
+		if string(k) == key {
+			return b[i : i+n], nil
+		}
+		i += n
+	}
+	return nil, nil
+}
+
+// valueLen b开头的一个bencode值的长度
+func valueLen(b []byte, depth int) (int, error) {
+	if len(b) == 0 || depth > maxBencodeDepth {
+		return 0, ErrInvalidBencode
+	}
+	switch c := b[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(b, 'e')
+		if end < 2 {
+			return 0, ErrInvalidBencode
+		}
+		return end + 1, nil
+	case c == 'l' || c == 'd':
+		i := 1
+		for i < len(b) {
+			if b[i] == 'e' {
+				return i + 1, nil
+			}
+			n, err := valueLen(b[i:], depth+1)
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+		return 0, ErrInvalidBencode
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(b, ':')
+		if colon < 1 {
+			return 0, ErrInvalidBencode
+		}
+		length, err := strconv.Atoi(string(b[:colon]))
+		if err != nil || length < 0 || length > len(b)-colon-1 {
+			return 0, ErrInvalidBencode
+		}
+		return colon + 1 + length, nil
+	}
+	return 0, ErrInvalidBencode
+}
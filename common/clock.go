@@ -0,0 +1,18 @@
+package common
+
+import "time"
+
+// Clock 时间来源, 测试时可以替换为可控的实现
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// RealClock 使用系统时间
+var RealClock Clock = realClock{}
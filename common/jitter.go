@@ -0,0 +1,30 @@
+package common
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultJitter 周期定时器默认的抖动比例, 即±10%
+const DefaultJitter = 0.1
+
+var (
+	jitterLock sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// JitteredInterval 在d上随机加减最多frac*d, 大量节点同时启动时定时器不会同步触发
+// frac<=0时返回d, 大于1时按1处理
+func JitteredInterval(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 || d <= 0 {
+		return d
+	}
+	if frac > 1 {
+		frac = 1
+	}
+	jitterLock.Lock()
+	r := jitterRand.Float64()
+	jitterLock.Unlock()
+	return d + time.Duration((r*2-1)*frac*float64(d))
+}
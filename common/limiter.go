@@ -0,0 +1,12 @@
+package common
+
+import "golang.org/x/time/rate"
+
+// NewLimiter 每秒perSecond次的令牌桶, 可以同时交给load.WithDialLimiter和dht.WithSendLimiter,
+// 让tcp连接和udp发包共用一个速率
+func NewLimiter(perSecond float64, burst int) *rate.Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
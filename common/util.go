@@ -39,15 +39,20 @@ func NeighborId(nodeId string, target string) string {
 }
 
 func MakeRequest(method string, nodeId string, target string) map[string]interface{} {
+	return MakeFindNode(method, nodeId, target, RandString(20))
+}
+
+// MakeFindNode neighbor非空时伪装成neighbor的邻居id, lookup为查询的目标id
+func MakeFindNode(method string, nodeId string, neighbor string, lookup string) map[string]interface{} {
 	neighborId := nodeId
-	if len(target) != 0 {
-		neighborId = NeighborId(nodeId, target)
+	if len(neighbor) != 0 {
+		neighborId = NeighborId(nodeId, neighbor)
 	}
 	ret := make(map[string]interface{})
 	ret["t"] = RandString(2)
 	ret["y"] = "q"
 	ret["q"] = method
-	ret["a"] = map[string]interface{}{"id": neighborId, "target": RandString(20)}
+	ret["a"] = map[string]interface{}{"id": neighborId, "target": lookup}
 
 	return ret
 }
@@ -61,10 +66,17 @@ func MakeResponse(t string, r map[string]interface{}) map[string]interface{} {
 	return ret
 }
 
+const Protocol = "BitTorrent protocol"
+
 func MakePreHeader() []byte {
+	return MakePreHeaderWithProtocol(Protocol)
+}
+
+// MakePreHeaderWithProtocol 握手头部: pstr长度 + pstr + 8字节保留位(声明支持扩展协议)
+func MakePreHeaderWithProtocol(pstr string) []byte {
 	buf := bytes.NewBuffer(nil)
-	buf.WriteByte(19)
-	buf.WriteString("BitTorrent protocol")
+	buf.WriteByte(byte(len(pstr)))
+	buf.WriteString(pstr)
 	buf.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00})
 	return buf.Bytes()
 }
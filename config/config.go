@@ -3,6 +3,7 @@ package config
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	"gopkg.in/yaml.v2"
@@ -10,6 +11,9 @@ import (
 
 type Config struct {
 	Host               string `yaml:"host"`
+	ListenPort         int    `yaml:"listen_port"`
+	NodeIdFile         string `yaml:"node_id_file"`
+	ExternalIp         string `yaml:"external_ip"`
 	PerSecondSendLimit int    `yaml:"per_second_send_limit"`
 	RequestBufLen      int    `yaml:"request_buf_len"`
 	ResponseBufLen     int    `yaml:"response_buf_len"`
@@ -19,6 +23,7 @@ type Config struct {
 	ReadTimeout        int    `yaml:"read_timeout"`
 	WriteTimeout       int    `yaml:"write_timeout"`
 	LoadBufLen         int    `yaml:"load_buf_len"`
+	MetaCacheLen       int    `yaml:"meta_cache_len"`
 	MongoUri           string `yaml:"mongo_uri"`
 	ElasticUrl         string `yaml:"elastic_url"`
 	ElasticName        string `yaml:"elastic_name"`
@@ -28,8 +33,11 @@ type Config struct {
 var Conf Config
 
 func init() {
-	limit := flag.Int("-l", 1000, "l 900")
-	flag.Parse()
+	//init在go test注册自己的参数之前执行, 用单独的FlagSet并忽略不认识的参数, 否则测试程序直接退出
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	limit := flags.Int("l", 1000, "l 900")
+	flags.Parse(os.Args[1:])
 
 	fp, err := os.OpenFile("./config.yaml", os.O_RDONLY, 0664)
 	if err != nil {
@@ -0,0 +1,212 @@
+package dht
+
+import (
+	"DHTsimple/common"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	//发出find_node后多久没有响应视为超时
+	routerTimeout = 10 * time.Second
+	//超时的路由节点在这段时间内不再优先使用
+	routerCooldown = 5 * time.Minute
+)
+
+var ErrBootstrapFailed = errors.New("bootstrap found no nodes")
+
+type router struct {
+	addr           string
+	resolved       string
+	lastSent       time.Time
+	lastReply      time.Time
+	unhealthyUntil time.Time
+	nodes          int
+}
+
+type RouterStat struct {
+	Addr      string
+	Healthy   bool
+	Nodes     int
+	LastReply time.Time
+}
+
+// routers 启动用的路由节点, 记录每个节点是否响应以及带来了多少节点
+type routers struct {
+	lock  sync.Mutex
+	list  []*router
+	clock common.Clock
+}
+
+func newRouters(addrs []string) *routers {
+	r := &routers{clock: common.RealClock}
+	for _, addr := range addrs {
+		r.list = append(r.list, &router{addr: addr})
+	}
+	return r
+}
+
+// pick 返回本次要查询的路由节点, 超时的节点冷却期内跳过, 都不可用时全部查询
+func (r *routers) pick() []*router {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.clock.Now()
+	var healthy []*router
+	for _, rt := range r.list {
+		if rt.lastSent.After(rt.lastReply) && now.Sub(rt.lastSent) > routerTimeout {
+			rt.unhealthyUntil = now.Add(routerCooldown)
+			rt.lastSent = time.Time{}
+		}
+		if now.After(rt.unhealthyUntil) {
+			healthy = append(healthy, rt)
+		}
+	}
+	if len(healthy) == 0 {
+		return r.list
+	}
+	return healthy
+}
+
+func (r *routers) sent(rt *router, resolved string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rt.resolved = resolved
+	if rt.lastSent.Before(rt.lastReply) || rt.lastSent.IsZero() {
+		rt.lastSent = r.clock.Now()
+	}
+}
+
+// replied 如果addr是路由节点则记录响应和带来的节点数
+func (r *routers) replied(addr *net.UDPAddr, nodes int) {
+	if addr == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, rt := range r.list {
+		if rt.resolved == addr.String() {
+			rt.lastReply = r.clock.Now()
+			rt.unhealthyUntil = time.Time{}
+			rt.nodes += nodes
+			return
+		}
+	}
+}
+
+func (r *routers) stats() []RouterStat {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := r.clock.Now()
+	ret := make([]RouterStat, 0, len(r.list))
+	for _, rt := range r.list {
+		ret = append(ret, RouterStat{
+			Addr:      rt.addr,
+			Healthy:   now.After(rt.unhealthyUntil),
+			Nodes:     rt.nodes,
+			LastReply: rt.lastReply,
+		})
+	}
+	return ret
+}
+
+// RouterStats 各个路由节点的健康状态以及带来的节点数
+func (d *DHT) RouterStats() []RouterStat {
+	return d.routers.stats()
+}
+
+func (d *DHT) addSend() {
+	for _, rt := range d.routers.pick() {
+		udpAddr, err := net.ResolveUDPAddr("udp", rt.addr)
+		if err != nil {
+			fmt.Printf("resolve router %s err:%s\n", rt.addr, err.Error())
+			continue
+		}
+		d.routers.sent(rt, udpAddr.String())
+
+		req := common.MakeFindNode("find_node", d.Id, "", d.targets.NextTarget())
+		d.request(&FindNodeReq{udpAddr.String(), req})
+	}
+}
+
+func (r *routers) addrs() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := make([]string, 0, len(r.list))
+	for _, rt := range r.list {
+		ret = append(ret, rt.addr)
+	}
+	return ret
+}
+
+// Bootstrap ping路由节点, 再从响应的节点出发向我们自己的id迭代find_node,
+// 直到最近的k个节点都已查询过, 响应的节点都会加入路由表
+// routers为空时使用WithBootstrapNodes设置的路由节点, 默认为公共路由节点
+func (d *DHT) Bootstrap(ctx context.Context, routers []string) error {
+	if len(routers) == 0 {
+		routers = d.routers.addrs()
+	}
+	var self [20]byte
+	copy(self[:], d.Id)
+	s := &shortlist{target: self, k: d.k, seen: make(map[string]bool)}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, addr := range routers {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			id, err := d.Ping(addr)
+			if err != nil {
+				fmt.Printf("ping router %s err:%s\n", addr, err.Error())
+				return
+			}
+			lock.Lock()
+			s.add(&candidate{addr: addr, id: id, known: true})
+			lock.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+
+	for ctx.Err() == nil {
+		round := s.next(d.alpha)
+		if len(round) == 0 {
+			break
+		}
+
+		var nodes []Node
+		for _, c := range round {
+			wg.Add(1)
+			go func(c *candidate) {
+				defer wg.Done()
+				n, err := d.FindNode(c.addr, self)
+				if err != nil {
+					return
+				}
+				lock.Lock()
+				nodes = append(nodes, n...)
+				lock.Unlock()
+			}(c)
+		}
+		wg.Wait()
+
+		for _, n := range nodes {
+			if n.Id == self {
+				continue
+			}
+			s.add(&candidate{addr: n.Addr.String(), id: n.Id, known: true})
+		}
+	}
+
+	if d.table.Len() == 0 {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return ErrBootstrapFailed
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package dht
+
+import (
+	"errors"
+	"time"
+)
+
+func responseId(r map[string]interface{}) ([20]byte, error) {
+	var id [20]byte
+	s, ok := r["id"].(string)
+	if !ok || len(s) != 20 {
+		return id, errors.New("invalid node id in response")
+	}
+	copy(id[:], s)
+	return id, nil
+}
+
+// Ping 返回对方的节点id
+func (d *DHT) Ping(node string) ([20]byte, error) {
+	r, err := d.query(node, "ping", map[string]interface{}{})
+	if err != nil {
+		return [20]byte{}, err
+	}
+	return responseId(r)
+}
+
+// FindNode 向node查询离target最近的节点
+func (d *DHT) FindNode(node string, target [20]byte) ([]Node, error) {
+	r, err := d.query(node, "find_node", map[string]interface{}{"target": string(target[:])})
+	if err != nil {
+		return nil, err
+	}
+	nodes, _ := r["nodes"].(string)
+	list, err := decodeCompactNodes(nodes)
+	if err != nil {
+		return nil, err
+	}
+	if nodes6, ok := r["nodes6"].(string); ok {
+		list6, err := DecodeCompactNodes6([]byte(nodes6))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, list6...)
+	}
+	return list, nil
+}
+
+// GetPeers 向node查询infoHash的peer, 对方没有peer时返回离infoHash更近的nodes用于继续查找
+func (d *DHT) GetPeers(node string, infoHash [20]byte) (peers []string, token []byte, nodes []string, err error) {
+	peers, token, list, err := d.getPeers(node, infoHash)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, n := range list {
+		nodes = append(nodes, n.Addr.String())
+	}
+	return peers, token, nodes, nil
+}
+
+func (d *DHT) getPeers(node string, infoHash [20]byte) (peers []string, token []byte, nodes []Node, err error) {
+	r, err := d.query(node, "get_peers", map[string]interface{}{"info_hash": string(infoHash[:])})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if t, ok := r["token"].(string); ok {
+		token = []byte(t)
+	}
+
+	if values, ok := r["values"].([]interface{}); ok {
+		for _, v := range values {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			list, err := decodeValues(s)
+			if err != nil {
+				continue
+			}
+			peers = append(peers, list...)
+		}
+	}
+
+	if s, ok := r["nodes"].(string); ok {
+		nodes, err = decodeCompactNodes(s)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return peers, token, nodes, nil
+}
+
+// AnnouncePeer 向node宣告我们在port上提供infoHash, token来自之前对该node的get_peers
+// 设置implied_port=1, 对方使用我们udp的源端口, 在nat后面时该端口才是可达的
+func (d *DHT) AnnouncePeer(node string, infoHash [20]byte, port int, token []byte) error {
+	if len(token) == 0 {
+		return errors.New("announce_peer needs a token from get_peers")
+	}
+	if port <= 0 || port > 65535 {
+		return errors.New("invalid port")
+	}
+	_, err := d.query(node, "announce_peer", map[string]interface{}{
+		"info_hash":    string(infoHash[:]),
+		"port":         port,
+		"implied_port": 1,
+		"token":        string(token),
+	})
+	return err
+}
+
+// SampleInfohashes BEP 51, 向node索取它存储的infohash样本
+// num为对方存储的infohash总数, interval内再次查询同一节点不会得到新的样本
+func (d *DHT) SampleInfohashes(node string) (samples [][20]byte, num int, interval time.Duration, nodes []string, err error) {
+	target := GenerateNodeID()
+	r, err := d.query(node, "sample_infohashes", map[string]interface{}{"target": string(target[:])})
+	if err != nil {
+		return nil, 0, 0, nil, err
+	}
+
+	s, _ := r["samples"].(string)
+	if len(s)%20 != 0 {
+		return nil, 0, 0, nil, errors.New("samples length error")
+	}
+	for i := 0; i < len(s); i += 20 {
+		var hash [20]byte
+		copy(hash[:], s[i:i+20])
+		samples = append(samples, hash)
+	}
+	if n, ok := r["num"].(int64); ok {
+		num = int(n)
+	}
+	if sec, ok := r["interval"].(int64); ok && sec > 0 {
+		interval = time.Duration(sec) * time.Second
+	}
+
+	if s, ok := r["nodes"].(string); ok {
+		list, err := decodeCompactNodes(s)
+		if err != nil {
+			return nil, 0, 0, nil, err
+		}
+		for _, n := range list {
+			nodes = append(nodes, n.Addr.String())
+		}
+	}
+	return samples, num, interval, nodes, nil
+}
@@ -0,0 +1,115 @@
+package dht
+
+import (
+	"DHTsimple/common"
+	"math/rand"
+	"sync"
+)
+
+// TargetStrategy 生成find_node的查询目标, 决定爬虫在id空间中的走向
+type TargetStrategy interface {
+	NextTarget() string
+	//Observe 记录发现的节点id
+	Observe(id string)
+}
+
+// UniformTargets 在整个id空间中均匀随机
+type UniformTargets struct{}
+
+func (UniformTargets) NextTarget() string {
+	return common.RandString(20)
+}
+
+func (UniformTargets) Observe(id string) {}
+
+// SparseTargets 按id首字节统计已发现的节点数, 偏向节点较少的区域
+type SparseTargets struct {
+	lock   sync.Mutex
+	counts [256]int
+}
+
+func (s *SparseTargets) Observe(id string) {
+	if len(id) == 0 {
+		return
+	}
+	s.lock.Lock()
+	s.counts[id[0]]++
+	s.lock.Unlock()
+}
+
+func (s *SparseTargets) NextTarget() string {
+	target := []byte(common.RandString(20))
+
+	s.lock.Lock()
+	//权重为 max/(count+1), 节点越少的区域越容易被选中
+	max := 0
+	for _, c := range s.counts {
+		if c > max {
+			max = c
+		}
+	}
+	weights := make([]int, len(s.counts))
+	total := 0
+	for i, c := range s.counts {
+		weights[i] = (max + 1) / (c + 1)
+		total += weights[i]
+	}
+	s.lock.Unlock()
+
+	n := rand.Intn(total)
+	for i, w := range weights {
+		if n < w {
+			target[0] = byte(i)
+			break
+		}
+		n -= w
+	}
+	return string(target)
+}
+
+// keyspace id前bits位与prefix相同的区域, 多台机器分工爬取时每个实例只处理自己的区域
+type keyspace struct {
+	prefix [20]byte
+	bits   int
+	//区域外的infohash交给forward, 可以为nil
+	forward func(Sniffed)
+}
+
+func (k *keyspace) contains(id [20]byte) bool {
+	return NodeID(id).CommonPrefixLen(NodeID(k.prefix)) >= k.bits
+}
+
+// apply 把id的前bits位替换为prefix
+func (k *keyspace) apply(id []byte) {
+	full := k.bits / 8
+	copy(id[:full], k.prefix[:full])
+	if rest := k.bits % 8; rest != 0 {
+		mask := byte(0xff) << uint(8-rest)
+		id[full] = k.prefix[full]&mask | id[full]&^mask
+	}
+}
+
+// keyspaceTargets 把其它策略生成的目标限制在keyspace内
+type keyspaceTargets struct {
+	TargetStrategy
+	space *keyspace
+}
+
+func (t keyspaceTargets) NextTarget() string {
+	target := []byte(t.TargetStrategy.NextTarget())
+	if len(target) == 20 {
+		t.space.apply(target)
+	}
+	return string(target)
+}
+
+// inKeyspace 没有设置WithKeyspaceFilter或hash在区域内时返回true, 否则把s交给forward并返回false
+func (d *DHT) inKeyspace(s Sniffed) bool {
+	if d.keyspace == nil || d.keyspace.contains(s.InfoHash) {
+		return true
+	}
+	if d.keyspace.forward != nil {
+		d.keyspace.forward(s)
+	}
+	return false
+}
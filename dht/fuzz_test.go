@@ -0,0 +1,40 @@
+//go:build go1.18
+
+package dht
+
+import (
+	"bytes"
+	"testing"
+)
+
+// go test -run XXX -fuzz FuzzDecodeCompactNodes ./dht/
+func FuzzDecodeCompactNodes(f *testing.F) {
+	f.Add([]byte("01234567890123456789\x7f\x00\x00\x01\x1a\xe1"))
+	f.Add([]byte("01234567890123456789\x7f\x00\x00\x01\x00\x00"))
+	f.Add(make([]byte, compactNode6Len))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		nodes, err := DecodeCompactNodes(b)
+		if err == nil {
+			for _, n := range nodes {
+				if n.Addr.Port == 0 || n.Addr.IP.To4() == nil {
+					t.Fatalf("decoded invalid node %v", n.Addr)
+				}
+			}
+			//端口为0的节点被跳过, 其余的编码后与原数据相同
+			var kept []byte
+			for i := 0; i+compactNodeLen <= len(b); i += compactNodeLen {
+				if b[i+compactNodeLen-2] != 0 || b[i+compactNodeLen-1] != 0 {
+					kept = append(kept, b[i:i+compactNodeLen]...)
+				}
+			}
+			if got := EncodeCompactNodes(nodes); !bytes.Equal(got, kept) {
+				t.Fatalf("re-encoded %x, want %x", got, kept)
+			}
+		} else if len(b)%compactNodeLen == 0 {
+			t.Fatalf("rejected %d bytes: %v", len(b), err)
+		}
+		if _, err := DecodeCompactNodes6(b); err == nil && len(b)%compactNode6Len != 0 {
+			t.Fatalf("accepted %d bytes as nodes6", len(b))
+		}
+	})
+}
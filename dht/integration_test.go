@@ -0,0 +1,70 @@
+//go:build integration
+
+package dht
+
+import (
+	"DHTsimple/common"
+	"DHTsimple/load"
+	"context"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+)
+
+// Sintel, WebTorrent示例中使用的公开torrent, 可以用DHT_TEST_INFOHASH换成其它infohash
+const integrationInfoHash = "08ada5a7a6183aae1e09d831df6748d566095a10"
+
+// 访问公网: go test -tags integration -run TestLookupThenFetch ./dht/
+func TestLookupThenFetch(t *testing.T) {
+	hashHex := integrationInfoHash
+	if s := os.Getenv("DHT_TEST_INFOHASH"); s != "" {
+		hashHex = s
+	}
+	b, err := hex.DecodeString(hashHex)
+	if err != nil || len(b) != 20 {
+		t.Fatalf("invalid infohash %q", hashHex)
+	}
+	var hash [20]byte
+	copy(hash[:], b)
+
+	d := NewDHT(WithListenAddr(":0"))
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		d.Close(ctx)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	lookupCtx, lookupCancel := context.WithTimeout(ctx, 30*time.Second)
+	peers, err := d.LookupPeers(lookupCtx, hash, seed)
+	lookupCancel()
+	if err != nil {
+		t.Fatalf("lookup peers: %v", err)
+	}
+	if len(peers) == 0 {
+		t.Fatal("no peers found")
+	}
+	t.Logf("found %d peers", len(peers))
+
+	ret, err := load.RaceMetadata(ctx, hash[:], peers, 8)
+	if err != nil {
+		t.Fatalf("fetch metadata from %d peers: %v", len(peers), err)
+	}
+	if ret.ChecksumMismatch {
+		t.Fatal("metadata does not match the infohash")
+	}
+	info, err := common.DecodeDict(ret.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, _ := info["name"].(string)
+	if name == "" {
+		t.Fatal("metadata has no name")
+	}
+	t.Logf("fetched %q, %d bytes from %d peers", name, len(ret.Data), ret.PeersTried)
+}
@@ -4,12 +4,12 @@ import (
 	"DHTsimple/common"
 	"DHTsimple/config"
 	"DHTsimple/load"
-	"bytes"
 	"context"
-	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"net"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/marksamman/bencode"
@@ -34,6 +34,9 @@ type Response struct {
 }
 
 type DHT struct {
+	//原子计数, 放在最前保证64位对齐
+	infoHashes int64
+
 	Host         string
 	Conn         *net.UDPConn
 	Id           string
@@ -41,17 +44,106 @@ type DHT struct {
 	ResponseList chan *Response
 	DataList     chan map[string]interface{}
 	Limiter      *rate.Limiter
+
+	routers    *routers
+	targets    TargetStrategy
+	trans      transactions
+	peers      *PeerStore
+	table      *RoutingTable
+	alpha      int
+	k          int
+	maxQueries int
+
+	queryTimeout time.Duration
+	retransmits  int
+	externalIP   net.IP
+	clock        common.Clock
+	//id由选项或文件指定, 不再按BEP 42生成
+	idSet bool
+
+	sniffed    chan<- Sniffed
+	fakeTokens bool
+	dedup      *sniffDedup
+
+	queryLimiter *rate.Limiter
+	ipLimiter    *ipLimiter
+
+	sent     counters
+	received counters
+	tokens   tokens
+
+	stopMaintenance func()
+	//与其它模块共享的发包限速器
+	sendLimiter *rate.Limiter
+	//BEP 43只读节点, 查询带ro=1, 不响应其它节点的查询
+	readOnly bool
+	//按距离和响应速度选择节点
+	preferResponsive bool
+	//Close时保存路由表, Start时从中恢复
+	tableFile string
+	//周期定时器的抖动比例
+	jitter float64
+	//只处理这个区域内的infohash
+	keyspace *keyspace
+
+	done      chan struct{}
+	closeOnce sync.Once
+	loops     sync.WaitGroup
 }
 
-func NewDHT() *DHT {
-	return &DHT{
+func NewDHT(opts ...Option) *DHT {
+	d := &DHT{
 		Host:         config.Conf.Host,
 		Id:           common.RandString(20),
 		RequestList:  make(chan *FindNodeReq, config.Conf.RequestBufLen),
 		ResponseList: make(chan *Response, config.Conf.ResponseBufLen),
 		DataList:     make(chan map[string]interface{}, config.Conf.DataBufLen),
 		Limiter:      rate.NewLimiter(rate.Every(time.Second/time.Duration(config.Conf.RequestBufLen)), config.Conf.PerSecondSendLimit),
+		routers:      newRouters(seed),
+		targets:      UniformTargets{},
+		peers:        NewPeerStore(peerTTL, maxPeerHashes, maxPeersPerKey),
+		alpha:        defaultAlpha,
+		k:            defaultK,
+		maxQueries:   defaultMaxQueries,
+		queryTimeout: defaultQueryTimeout,
+		retransmits:  defaultRetransmits,
+		clock:        common.RealClock,
+		fakeTokens:   false,
+		jitter:       common.DefaultJitter,
+		done:         make(chan struct{}),
+	}
+	if config.Conf.NodeIdFile != "" {
+		WithNodeIDFile(config.Conf.NodeIdFile)(d)
+	}
+	if ip := net.ParseIP(config.Conf.ExternalIp); ip != nil {
+		WithExternalIP(ip)(d)
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.externalIP != nil && !d.idSet {
+		if id, err := GenerateSecureNodeID(d.externalIP); err == nil {
+			d.Id = string(id[:])
+		}
+	}
+	var self [20]byte
+	copy(self[:], d.Id)
+	if d.keyspace != nil {
+		d.targets = keyspaceTargets{TargetStrategy: d.targets, space: d.keyspace}
+	}
+	d.table = NewRoutingTable(self, d.k)
+	d.table.SetClock(d.clock)
+	d.table.SetJitter(d.jitter)
+	d.routers.clock = d.clock
+	d.peers.SetClock(d.clock)
+	d.tokens.clock = d.clock
+	if d.ipLimiter != nil {
+		d.ipLimiter.clock = d.clock
 	}
+	if d.externalIP != nil {
+		d.table.SetExternalIP(d.externalIP)
+	}
+	return d
 }
 
 func (d *DHT) Start() error {
@@ -63,21 +155,146 @@ func (d *DHT) Start() error {
 	if err != nil {
 		return err
 	}
+	d.table.SetSelfAddr(d.Conn.LocalAddr().(*net.UDPAddr))
 
 	d.rung("sendRequest", d.sendRequest)
 	d.rung("sendResponse", d.sendResponse)
 	d.rung("handleData", d.handleData)
 	d.rung("readResponse", d.readResponse)
 	d.rung("seedLoop", d.seedLoop)
+	d.rung("expireLoop", d.expireLoop)
+	d.rung("refreshLoop", d.refreshLoop)
+	d.stopMaintenance = d.table.StartMaintenance(d, maintenanceInterval)
+	if d.tableFile != "" {
+		d.loadTable(d.tableFile)
+	}
 	return nil
 }
 
+// Close 停止所有goroutine和路由表维护, 关闭udp socket, WithRoutingTableFile时保存路由表,
+// Sniffer的C也会被关闭. ctx结束前goroutine没有全部退出时返回ctx.Err(), 但仍会保存路由表
+// 关闭后的DHT不能再次Start
+func (d *DHT) Close(ctx context.Context) error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.done)
+		if d.stopMaintenance != nil {
+			d.stopMaintenance()
+		}
+		d.table.StopEvents()
+		if d.Conn != nil {
+			d.Conn.Close()
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			d.loops.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			if d.sniffed != nil {
+				close(d.sniffed)
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if d.tableFile != "" {
+			if e := d.saveTable(d.tableFile); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// closed Close之后为true
+func (d *DHT) closed() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// request 交给sendRequest发送, Close之后丢弃
+func (d *DHT) request(req *FindNodeReq) {
+	select {
+	case d.RequestList <- req:
+	case <-d.done:
+	}
+}
+
+// respond 交给sendResponse发送, Close之后丢弃
+func (d *DHT) respond(resp *Response) {
+	select {
+	case d.ResponseList <- resp:
+	case <-d.done:
+	}
+}
+
+// saveTable 以nodes字段的格式保存路由表中的ipv4节点
+func (d *DHT) saveTable(path string) error {
+	var self [20]byte
+	copy(self[:], d.Id)
+	nodes := d.table.Closest(self, d.table.Len())
+	return ioutil.WriteFile(path, EncodeCompactNodes(nodes), 0644)
+}
+
+// loadTable 向上次保存的节点发送find_node, 响应的节点才会加入路由表
+func (d *DHT) loadTable(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("load routing table from %s err:%s\n", path, err.Error())
+		return
+	}
+	nodes, err := DecodeCompactNodes(data)
+	if err != nil {
+		fmt.Printf("load routing table from %s err:%s\n", path, err.Error())
+		return
+	}
+	go func() {
+		for _, node := range nodes {
+			req := common.MakeFindNode("find_node", d.Id, "", d.Id)
+			d.request(&FindNodeReq{Addr: node.Addr.String(), Req: req})
+		}
+	}()
+}
+
+// LocalAddr 所有查询和响应共用的udp socket的本地地址, Start之前为nil
+func (d *DHT) LocalAddr() *net.UDPAddr {
+	if d.Conn == nil {
+		return nil
+	}
+	return d.Conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (d *DHT) expireLoop() {
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-d.clock.After(d.interval(5 * time.Minute)):
+		}
+		d.peers.Expire()
+		if d.ipLimiter != nil {
+			d.ipLimiter.expire(5 * time.Minute)
+		}
+		if d.dedup != nil {
+			d.dedup.expire(d.clock.Now())
+		}
+	}
+}
+
 func (d *DHT) seedLoop() {
 	d.addSend()
-	timer := time.NewTicker(15 * time.Second)
 	for {
 		select {
-		case <-timer.C:
+		case <-d.done:
+			return
+		case <-d.clock.After(d.interval(15 * time.Second)):
 			if len(d.RequestList) == 0 {
 				d.addSend()
 			}
@@ -85,12 +302,16 @@ func (d *DHT) seedLoop() {
 	}
 }
 
-func (d *DHT) addSend() {
-	for _, addr := range seed {
+// interval 加上抖动的定时器周期
+func (d *DHT) interval(period time.Duration) time.Duration {
+	return common.JitteredInterval(period, d.jitter)
+}
 
-		req := common.MakeRequest("find_node", d.Id, "")
-		findNodeReq := &FindNodeReq{addr, req}
-		d.RequestList <- findNodeReq
+// wait 发送udp包前等待自身和共享的限速器
+func (d *DHT) wait() {
+	d.Limiter.Wait(context.Background())
+	if d.sendLimiter != nil {
+		d.sendLimiter.Wait(context.Background())
 	}
 }
 
@@ -105,13 +326,19 @@ func (d *DHT) rung(name string, localFunc func()) {
 		localFunc()
 	}
 
-	go f()
+	d.loops.Add(1)
+	go func() {
+		defer d.loops.Done()
+		f()
+	}()
 }
 
 func (d *DHT) sendRequest() {
 	for {
-		d.Limiter.Wait(context.Background())
+		d.wait()
 		select {
+		case <-d.done:
+			return
 		case req := <-d.RequestList:
 
 			udpAddr, err := net.ResolveUDPAddr("udp", req.Addr)
@@ -120,9 +347,16 @@ func (d *DHT) sendRequest() {
 				continue
 			}
 
+			if d.readOnly {
+				req.Req["ro"] = 1
+			}
 			_, err = d.Conn.WriteToUDP(bencode.Encode(req.Req), udpAddr)
 			if err != nil {
 				fmt.Printf("sendRequest err:%s", err.Error())
+				continue
+			}
+			if q, ok := req.Req["q"].(string); ok {
+				d.sent.add(q)
 			}
 		}
 	}
@@ -130,8 +364,10 @@ func (d *DHT) sendRequest() {
 
 func (d *DHT) sendResponse() {
 	for {
-		d.Limiter.Wait(context.Background())
+		d.wait()
 		select {
+		case <-d.done:
+			return
 		case resp := <-d.ResponseList:
 
 			r := common.MakeResponse(resp.T, resp.R)
@@ -148,22 +384,31 @@ func (d *DHT) readResponse() {
 	for {
 		n, addr, err := d.Conn.ReadFromUDP(readBuf)
 		if err != nil {
+			if d.closed() {
+				return
+			}
 			fmt.Printf("read err:%s", err.Error())
 			continue
 		}
-		msg, err := bencode.Decode(bytes.NewBuffer(readBuf[:n]))
+		msg, err := common.DecodeDict(readBuf[:n])
 		if err != nil {
 			fmt.Printf("decode buf error:%s\n", err.Error())
 			continue
 		}
 		msg["remote_addr"] = addr
-		d.DataList <- msg
+		select {
+		case d.DataList <- msg:
+		case <-d.done:
+			return
+		}
 	}
 }
 
 func (d *DHT) handleData() {
 	for {
 		select {
+		case <-d.done:
+			return
 		case data := <-d.DataList:
 			{
 				y, ok := data["y"].(string)
@@ -178,17 +423,29 @@ func (d *DHT) handleData() {
 				}
 				remoteAddr, _ := data["remote_addr"].(*net.UDPAddr)
 
+				if (y == "r" || y == "e") && d.trans.resolve(t, remoteAddr, data) {
+					continue
+				}
+
 				if y == "q" {
+					if d.readOnly {
+						continue
+					}
+					if remoteAddr == nil || !d.allowQuery(remoteAddr.IP.String()) {
+						continue
+					}
 					q, ok := data["q"].(string)
 					if !ok {
 						fmt.Printf("msg q is not string\n")
 						continue
 					}
+					d.received.add(q)
 					switch q {
 					case "ping":
 						d.doPing(remoteAddr, t)
 					case "find_node":
-						d.doFindNode(remoteAddr, t)
+						a, _ := data["a"].(map[string]interface{})
+						d.doFindNode(remoteAddr, t, a)
 					case "get_peers":
 						a, ok := data["a"].(map[string]interface{})
 						if !ok {
@@ -209,7 +466,8 @@ func (d *DHT) handleData() {
 					if !ok {
 						break
 					}
-					d.decodeNodes(r)
+					d.seen(r, remoteAddr, 0)
+					d.routers.replied(remoteAddr, d.decodeNodes(r))
 				} else if y == "e" {
 					//e, _ := data["e"]
 					//fmt.Printf("msg get a err :%v\n", e)
@@ -227,16 +485,27 @@ func (d *DHT) doPing(addr *net.UDPAddr, t string) {
 	resp.R = map[string]interface{}{"id": d.Id}
 	resp.T = t
 	resp.Addr = addr
-	d.ResponseList <- resp
+	d.respond(resp)
 
 }
 
-func (d *DHT) doFindNode(addr *net.UDPAddr, t string) {
+// closestNodes 路由表中离target最近的节点, 编码为nodes字段
+func (d *DHT) closestNodes(target string) string {
+	if len(target) != 20 {
+		return ""
+	}
+	var id [20]byte
+	copy(id[:], target)
+	return string(EncodeCompactNodes(d.closest(id, d.k)))
+}
+
+func (d *DHT) doFindNode(addr *net.UDPAddr, t string, arg map[string]interface{}) {
+	target, _ := arg["target"].(string)
 	r := make(map[string]interface{})
-	r["nodes"] = ""
+	r["nodes"] = d.closestNodes(target)
 	r["id"] = d.Id
 	resp := &Response{Addr: addr, T: t, R: r}
-	d.ResponseList <- resp
+	d.respond(resp)
 }
 
 func (d *DHT) doGetPeer(addr *net.UDPAddr, t string, arg map[string]interface{}) {
@@ -248,25 +517,43 @@ func (d *DHT) doGetPeer(addr *net.UDPAddr, t string, arg map[string]interface{})
 	}
 
 	r := make(map[string]interface{})
-	r["nodes"] = ""
-	r["token"] = common.MakeToken(addr.String())
+	r["nodes"] = d.closestNodes(infoHash)
+	r["token"] = string(d.issueToken(addr.IP))
 	r["id"] = common.NeighborId(d.Id, infoHash)
+
+	var hash [20]byte
+	copy(hash[:], infoHash)
+	var values []interface{}
+	for _, peer := range d.peers.Peers(hash, 50) {
+		if v := encodeCompactPeer(peer); v != "" {
+			values = append(values, v)
+		}
+	}
+	if len(values) > 0 {
+		r["values"] = values
+	}
 	resp := &Response{Addr: addr, T: t, R: r}
 
-	d.ResponseList <- resp
+	d.respond(resp)
+
+	if len(infoHash) == 20 {
+		s := Sniffed{InfoHash: hash, Query: "get_peers", Source: addr.String()}
+		if !d.inKeyspace(s) {
+			return
+		}
+		atomic.AddInt64(&d.infoHashes, 1)
+		d.sniff(s)
+	}
 }
 
 func (d *DHT) doAnnouncePeer(addr *net.UDPAddr, t string, arg map[string]interface{}) {
-	//token, ok := arg["token"].(string)
-	//if !ok {
-	//	fmt.Println("doAnnouncePeer no token")
-	//	return
-	//}
-
-	//if !ValidateToken(token, addr.String()) {
-	//	fmt.Println("doAnnouncePeer token un match")
-	//	return
-	//}
+	//伪造token时token不对也继续收集announce, 但只有校验通过的peer才保存
+	token, _ := arg["token"].(string)
+	valid := token != "" && d.validateToken([]byte(token), addr.IP)
+	if !valid && !d.fakeTokens {
+		fmt.Println("doAnnouncePeer token un match")
+		return
+	}
 
 	infoHash, ok := arg["info_hash"].(string)
 	if !ok {
@@ -274,22 +561,39 @@ func (d *DHT) doAnnouncePeer(addr *net.UDPAddr, t string, arg map[string]interfa
 		return
 	}
 
-	p, ok := arg["port"].(int64)
-	if !ok {
-		p = int64(addr.Port)
-	}
-	port := p
-
+	//implied_port非0时以udp源端口为准, 忽略port字段
+	var port int64
 	if impliedPort, ok := arg["implied_port"].(int64); ok && impliedPort != 0 {
 		port = int64(addr.Port)
+	} else if p, ok := arg["port"].(int64); ok {
+		port = p
+	} else {
+		fmt.Println("doAnnouncePeer no port")
+		return
 	}
 
-	if port <= 0 || port >= 65535 {
+	if port <= 0 || port > 65535 {
 		return
 	}
 
 	peer := &net.TCPAddr{IP: addr.IP, Port: int(port)}
-	load.HashChan <- load.HashPair{Hash: []byte(infoHash), Addr: peer.String()}
+	if len(infoHash) == 20 {
+		var hash [20]byte
+		copy(hash[:], infoHash)
+		s := Sniffed{InfoHash: hash, Query: "announce_peer", Source: addr.String(), Peer: peer.String()}
+		if !d.inKeyspace(s) {
+			return
+		}
+		if valid {
+			d.peers.Announce(hash, peer.String())
+		}
+		atomic.AddInt64(&d.infoHashes, 1)
+		d.sniff(s)
+	}
+	select {
+	case load.HashChan <- load.HashPair{Hash: []byte(infoHash), Addr: peer.String()}:
+	case <-d.done:
+	}
 
 	//r := make(map[string]interface{})
 	//r["id"] = d.Id
@@ -298,31 +602,26 @@ func (d *DHT) doAnnouncePeer(addr *net.UDPAddr, t string, arg map[string]interfa
 	//d.ResponseList <- resp
 }
 
-//nodes 0-19为id,20-23为ip,24-25为端口
-func (d *DHT) decodeNodes(r map[string]interface{}) {
+// nodes 0-19为id,20-23为ip,24-25为端口, 返回解析出的节点数
+func (d *DHT) decodeNodes(r map[string]interface{}) int {
 	nodes, ok := r["nodes"].(string)
 	if !ok {
-		return
+		return 0
 	}
 
-	length := len(nodes)
-	if length%26 != 0 {
-		fmt.Println("node can not mod 26")
-		return
+	list, err := decodeCompactNodes(nodes)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 0
 	}
 
-	for i := 0; i < length; i += 26 {
-		id := nodes[i : i+20]
-		ip := net.IP(nodes[i+20 : i+24]).String()
-		port := binary.BigEndian.Uint16([]byte(nodes[i+24 : i+26]))
-		if port <= 0 || port >= 65535 {
-			continue
-		}
-		addr := ip + ":" + strconv.Itoa(int(port))
-		r := common.MakeRequest("find_node", d.Id, id)
-		req := &FindNodeReq{Addr: addr, Req: r}
-		d.RequestList <- req
+	for _, node := range list {
+		id := string(node.Id[:])
+		d.targets.Observe(id)
+		r := common.MakeFindNode("find_node", d.Id, id, d.targets.NextTarget())
+		req := &FindNodeReq{Addr: node.Addr.String(), Req: r}
+		d.request(req)
 	}
 
-	return
+	return len(list)
 }
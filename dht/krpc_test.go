@@ -0,0 +1,316 @@
+package dht
+
+import (
+	"DHTsimple/common"
+	"DHTsimple/config"
+	"DHTsimple/load"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/marksamman/bencode"
+)
+
+func TestMain(m *testing.M) {
+	//测试目录下没有config.yaml
+	config.Conf.RequestBufLen = 16
+	config.Conf.ResponseBufLen = 16
+	config.Conf.DataBufLen = 16
+	config.Conf.PerSecondSendLimit = 100
+	//announce_peer把infohash交给metadata下载, 测试中直接丢弃
+	go func() {
+		for range load.HashChan {
+		}
+	}()
+	os.Exit(m.Run())
+}
+
+func startDHT(t *testing.T, opts ...Option) *DHT {
+	t.Helper()
+	d := NewDHT(append([]Option{WithBootstrapNodes(nil), WithListenAddr("127.0.0.1:0")}, opts...)...)
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		d.Close(ctx)
+	})
+	return d
+}
+
+// krpcConn 直接收发krpc消息的udp连接, 用来模拟其它节点
+type krpcConn struct {
+	t    *testing.T
+	conn *net.UDPConn
+	id   [20]byte
+}
+
+func newKrpcConn(t *testing.T) *krpcConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &krpcConn{t: t, conn: conn, id: GenerateNodeID()}
+}
+
+func (c *krpcConn) addr() *net.UDPAddr {
+	return c.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (c *krpcConn) send(to *net.UDPAddr, msg map[string]interface{}) {
+	c.t.Helper()
+	if _, err := c.conn.WriteToUDP(bencode.Encode(msg), to); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *krpcConn) recv() (map[string]interface{}, *net.UDPAddr) {
+	c.t.Helper()
+	buf := make([]byte, 2048)
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, from, err := c.conn.ReadFromUDP(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	msg, err := common.DecodeDict(buf[:n])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return msg, from
+}
+
+// query 发送查询并返回响应中的r
+func (c *krpcConn) query(to *net.UDPAddr, q string, a map[string]interface{}) map[string]interface{} {
+	c.t.Helper()
+	a["id"] = string(c.id[:])
+	c.send(to, map[string]interface{}{"t": "aa", "y": "q", "q": q, "a": a})
+	resp, _ := c.recv()
+	r, ok := resp["r"].(map[string]interface{})
+	if !ok {
+		c.t.Fatalf("%s got no r: %v", q, resp)
+	}
+	return r
+}
+
+func TestAnnouncePeerSendsImpliedPort(t *testing.T) {
+	d := startDHT(t)
+	remote := newKrpcConn(t)
+	hash := GenerateNodeID()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.AnnouncePeer(remote.addr().String(), hash, 6881, []byte("token"))
+	}()
+
+	msg, from := remote.recv()
+	if q, _ := msg["q"].(string); q != "announce_peer" {
+		t.Fatalf("got query %q", q)
+	}
+	a, _ := msg["a"].(map[string]interface{})
+	if implied, _ := a["implied_port"].(int64); implied != 1 {
+		t.Fatalf("implied_port = %v, want 1", a["implied_port"])
+	}
+	if port, _ := a["port"].(int64); port != 6881 {
+		t.Fatalf("port = %v, want 6881", a["port"])
+	}
+	remote.send(from, map[string]interface{}{"t": msg["t"], "y": "r", "r": map[string]interface{}{"id": string(remote.id[:])}})
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnnouncePeerHonorsImpliedPort(t *testing.T) {
+	d := startDHT(t)
+	target := d.LocalAddr()
+
+	tests := []struct {
+		name    string
+		implied int
+		//0时为remote的udp源端口
+		want int
+	}{
+		//implied_port=1时使用udp源端口, 忽略port
+		{"implied", 1, 0},
+		{"explicit", 0, 6881},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := newKrpcConn(t)
+			hash := GenerateNodeID()
+			r := remote.query(target, "get_peers", map[string]interface{}{"info_hash": string(hash[:])})
+			token, _ := r["token"].(string)
+			//我们不回复announce_peer, 只检查peer存储
+			remote.send(target, map[string]interface{}{"t": "bb", "y": "q", "q": "announce_peer", "a": map[string]interface{}{
+				"id":           string(remote.id[:]),
+				"info_hash":    string(hash[:]),
+				"port":         6881,
+				"implied_port": tt.implied,
+				"token":        token,
+			}})
+
+			want := tt.want
+			if want == 0 {
+				want = remote.addr().Port
+			}
+			wantAddr := (&net.TCPAddr{IP: remote.addr().IP, Port: want}).String()
+			var peers []string
+			for i := 0; i < 100; i++ {
+				if peers = d.peers.Peers(hash, 10); len(peers) > 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(peers) != 1 || peers[0] != wantAddr {
+				t.Fatalf("stored peers %v, want [%s]", peers, wantAddr)
+			}
+		})
+	}
+}
+
+func TestAnnouncePeerRejectsBadToken(t *testing.T) {
+	d := startDHT(t)
+	target := d.LocalAddr()
+	remote := newKrpcConn(t)
+	hash := GenerateNodeID()
+
+	//没有先get_peers, token不是我们发出的
+	remote.send(target, map[string]interface{}{"t": "bb", "y": "q", "q": "announce_peer", "a": map[string]interface{}{
+		"id":        string(remote.id[:]),
+		"info_hash": string(hash[:]),
+		"port":      6881,
+		"token":     "forged",
+	}})
+	//ping的响应到达时announce_peer已经处理完
+	remote.query(target, "ping", map[string]interface{}{})
+	if peers := d.peers.Peers(hash, 10); len(peers) != 0 {
+		t.Fatalf("stored peers %v for a forged token", peers)
+	}
+}
+
+func TestFakeTokensDoNotStorePeers(t *testing.T) {
+	s := NewSniffer(16, WithBootstrapNodes(nil), WithListenAddr("127.0.0.1:0"))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		s.Close(ctx)
+	})
+	remote := newKrpcConn(t)
+	hash := GenerateNodeID()
+
+	remote.send(s.LocalAddr(), map[string]interface{}{"t": "bb", "y": "q", "q": "announce_peer", "a": map[string]interface{}{
+		"id":        string(remote.id[:]),
+		"info_hash": string(hash[:]),
+		"port":      6881,
+		"token":     "forged",
+	}})
+	select {
+	case got := <-s.C:
+		if got.InfoHash != hash || got.Query != "announce_peer" {
+			t.Fatalf("sniffed %+v", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("announce with a forged token was not sniffed")
+	}
+	if peers := s.peers.Peers(hash, 10); len(peers) != 0 {
+		t.Fatalf("stored peers %v for a forged token", peers)
+	}
+}
+
+// 来源地址不是查询发往的地址时, 即使t正确也不能当作响应
+func TestQueryIgnoresSpoofedResponse(t *testing.T) {
+	d := startDHT(t)
+	remote := newKrpcConn(t)
+	spoofer := newKrpcConn(t)
+
+	type result struct {
+		id  [20]byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		id, err := d.Ping(remote.addr().String())
+		done <- result{id, err}
+	}()
+
+	msg, from := remote.recv()
+	spoofer.send(from, map[string]interface{}{"t": msg["t"], "y": "r", "r": map[string]interface{}{"id": string(spoofer.id[:])}})
+	//ping的响应到达时伪造的响应已经处理完
+	spoofer.query(from, "ping", map[string]interface{}{})
+	select {
+	case r := <-done:
+		t.Fatalf("query resolved by a spoofed response: %x %v", r.id, r.err)
+	default:
+	}
+
+	remote.send(from, map[string]interface{}{"t": msg["t"], "y": "r", "r": map[string]interface{}{"id": string(remote.id[:])}})
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.id != remote.id {
+		t.Fatalf("ping got id %x, want %x", r.id, remote.id)
+	}
+}
+
+// 任何查询超时都记录到路由表中对应的节点
+func TestQueryTimeoutMarksNodeFailed(t *testing.T) {
+	d := startDHT(t, WithQueryTimeout(50*time.Millisecond), WithRetransmits(0))
+	//不回复的节点
+	silent := newKrpcConn(t)
+	id := GenerateNodeID()
+	d.table.Insert(Node{Id: id, Addr: silent.addr()})
+
+	fails := func() int {
+		for _, n := range d.table.Closest(id, 1) {
+			if n.Id == id {
+				return n.Fails
+			}
+		}
+		t.Fatal("node removed from routing table")
+		return 0
+	}
+	for want := 1; want <= 2; want++ {
+		if _, err := d.FindNode(silent.addr().String(), id); !errors.Is(err, ErrQueryTimeout) {
+			t.Fatalf("find_node err %v, want timeout", err)
+		}
+		if got := fails(); got != want {
+			t.Fatalf("fails = %d after %d timeouts", got, want)
+		}
+	}
+}
+
+// Close之后Start启动的goroutine, 包括路由表维护, 都应该退出
+func TestCloseStopsGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	d := NewDHT(WithBootstrapNodes(nil), WithListenAddr("127.0.0.1:0"))
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	remote := newKrpcConn(t)
+	remote.query(d.LocalAddr(), "ping", map[string]interface{}{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := d.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for i := 0; i < 100; i++ {
+		if n = runtime.NumGoroutine(); n <= before {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	buf := make([]byte, 1<<16)
+	t.Fatalf("%d goroutines before Start, %d after Close:\n%s", before, n, buf[:runtime.Stack(buf, true)])
+}
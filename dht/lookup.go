@@ -0,0 +1,189 @@
+package dht
+
+import (
+	"DHTsimple/load"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+const (
+	//默认并发查询数
+	defaultAlpha = 3
+	//默认k值, 每轮只在最近的k个节点中选择查询对象, 也是k桶的大小
+	defaultK = 8
+	//一次查找最多查询的节点数
+	defaultMaxQueries = 64
+)
+
+var ErrNoPeersFound = errors.New("no peers found")
+
+type candidate struct {
+	addr    string
+	id      [20]byte
+	known   bool
+	queried bool
+}
+
+// shortlist 按与target的xor距离排序的候选节点, id未知的启动节点排在最前
+type shortlist struct {
+	target [20]byte
+	k      int
+	list   []*candidate
+	seen   map[string]bool
+}
+
+func (s *shortlist) add(c *candidate) {
+	if s.seen[c.addr] {
+		return
+	}
+	s.seen[c.addr] = true
+	s.list = append(s.list, c)
+	sort.SliceStable(s.list, func(i, j int) bool {
+		a, b := s.list[i], s.list[j]
+		if a.known != b.known {
+			return !a.known
+		}
+		return closer(s.target, a.id, b.id)
+	})
+}
+
+// next 从最近的k个节点中取最多n个未查询的
+func (s *shortlist) next(n int) []*candidate {
+	var ret []*candidate
+	for i, c := range s.list {
+		if i >= s.k && c.known {
+			break
+		}
+		if !c.queried {
+			c.queried = true
+			ret = append(ret, c)
+			if len(ret) == n {
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// LookupPeers 从bootstrap出发迭代查询离infoHash越来越近的节点, 直到找到peer, 没有更近的节点或查询数达到上限
+// ctx结束时返回已经收到的peer, 一个都没有时才返回ctx.Err()
+func (d *DHT) LookupPeers(ctx context.Context, infoHash [20]byte, bootstrap []string) ([]string, error) {
+	s := &shortlist{target: infoHash, k: d.k, seen: make(map[string]bool)}
+	for _, addr := range bootstrap {
+		s.add(&candidate{addr: addr})
+	}
+
+	var lock sync.Mutex
+	found := make(map[string]bool)
+	var peers []string
+	//超时返回后仍在进行的查询可能继续写入peers, 返回时复制一份
+	result := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), peers...)
+	}
+
+	queried := 0
+	for ctx.Err() == nil && queried < d.maxQueries {
+		n := d.alpha
+		if left := d.maxQueries - queried; n > left {
+			n = left
+		}
+		round := s.next(n)
+		if len(round) == 0 {
+			break
+		}
+		queried += len(round)
+
+		var wg sync.WaitGroup
+		var nodes []Node
+		for _, c := range round {
+			wg.Add(1)
+			go func(c *candidate) {
+				defer wg.Done()
+				p, _, n, err := d.getPeers(c.addr, infoHash)
+				if err != nil {
+					return
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				for _, peer := range p {
+					if !found[peer] {
+						found[peer] = true
+						peers = append(peers, peer)
+					}
+				}
+				nodes = append(nodes, n...)
+			}(c)
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			if ret := result(); len(ret) > 0 {
+				return ret, nil
+			}
+			return nil, ctx.Err()
+		}
+
+		if len(peers) > 0 {
+			return result(), nil
+		}
+		for _, n := range nodes {
+			s.add(&candidate{addr: n.Addr.String(), id: n.Id, known: true})
+		}
+	}
+
+	if ret := result(); len(ret) > 0 {
+		return ret, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, ErrNoPeersFound
+}
+
+// PeerSource 把LookupPeers作为load.PeerSource, 从路由表中离infohash最近的节点出发, 路由表为空时从路由节点出发
+func (d *DHT) PeerSource() load.PeerSource {
+	return dhtSource{d}
+}
+
+type dhtSource struct {
+	d *DHT
+}
+
+func (s dhtSource) Peers(ctx context.Context, infoHash [20]byte) (<-chan net.Addr, error) {
+	var bootstrap []string
+	for _, n := range s.d.closest(infoHash, s.d.k) {
+		bootstrap = append(bootstrap, n.Addr.String())
+	}
+	if len(bootstrap) == 0 {
+		bootstrap = s.d.routers.addrs()
+	}
+
+	ch := make(chan net.Addr)
+	go func() {
+		defer close(ch)
+		peers, err := s.d.LookupPeers(ctx, infoHash, bootstrap)
+		if err != nil {
+			fmt.Printf("lookup peers of %x err:%s\n", infoHash, err.Error())
+			return
+		}
+		for _, p := range peers {
+			select {
+			case ch <- load.PeerAddr(p):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
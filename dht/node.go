@@ -0,0 +1,153 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net"
+	"time"
+)
+
+const (
+	compactNodeLen  = 26
+	compactNode6Len = 38
+)
+
+type Node struct {
+	Id       [20]byte
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+	//查询往返时间的指数移动平均, 0为还没有测量过
+	RTT time.Duration
+	//最近一次响应后连续超时的次数
+	Fails int
+}
+
+// rttEma 新样本占1/8, 与tcp的srtt相同
+func rttEma(old, sample time.Duration) time.Duration {
+	if old == 0 {
+		return sample
+	}
+	return old - old/8 + sample/8
+}
+
+func decodeCompactNodes(nodes string) ([]Node, error) {
+	return DecodeCompactNodes([]byte(nodes))
+}
+
+// DecodeCompactNodes 解析nodes字段, 每个节点26字节: 0-19为id,20-23为ip,24-25为端口, 跳过端口为0的节点
+func DecodeCompactNodes(b []byte) ([]Node, error) {
+	return decodeNodes(b, compactNodeLen)
+}
+
+// DecodeCompactNodes6 解析nodes6字段, 每个节点38字节: 0-19为id,20-35为ip,36-37为端口
+func DecodeCompactNodes6(b []byte) ([]Node, error) {
+	return decodeNodes(b, compactNode6Len)
+}
+
+func decodeNodes(b []byte, size int) ([]Node, error) {
+	if len(b)%size != 0 {
+		return nil, fmt.Errorf("compact nodes length %d is not a multiple of %d", len(b), size)
+	}
+	ret := make([]Node, 0, len(b)/size)
+	for i := 0; i < len(b); i += size {
+		port := binary.BigEndian.Uint16(b[i+size-2 : i+size])
+		if port == 0 {
+			continue
+		}
+		var n Node
+		copy(n.Id[:], b[i:i+20])
+		ip := make(net.IP, size-22)
+		copy(ip, b[i+20:i+size-2])
+		n.Addr = &net.UDPAddr{IP: ip, Port: int(port)}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+// EncodeCompactNodes 编码为nodes字段, 不是ipv4的节点被跳过
+func EncodeCompactNodes(nodes []Node) []byte {
+	return encodeNodes(nodes, false)
+}
+
+// EncodeCompactNodes6 编码为nodes6字段, ipv4的节点被跳过
+func EncodeCompactNodes6(nodes []Node) []byte {
+	return encodeNodes(nodes, true)
+}
+
+func encodeNodes(nodes []Node, ipv6 bool) []byte {
+	size := compactNodeLen
+	if ipv6 {
+		size = compactNode6Len
+	}
+	buf := make([]byte, 0, len(nodes)*size)
+	for _, n := range nodes {
+		if n.Addr == nil || n.Addr.Port <= 0 || n.Addr.Port > 65535 {
+			continue
+		}
+		ip := n.Addr.IP.To4()
+		if ipv6 {
+			if ip != nil {
+				continue
+			}
+			ip = n.Addr.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, n.Id[:]...)
+		buf = append(buf, ip...)
+		buf = append(buf, byte(n.Addr.Port>>8), byte(n.Addr.Port))
+	}
+	return buf
+}
+
+// NodeID 160位的节点id或infohash, 按xor距离比较
+type NodeID [20]byte
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance 与other的xor距离
+func (id NodeID) Distance(other NodeID) NodeID {
+	var d NodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// CommonPrefixLen 与other相同的前缀位数, 相同时为160
+func (id NodeID) CommonPrefixLen(other NodeID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return idBits
+}
+
+// Compare 比较a和b到id的距离, a更近时返回-1, 相同时返回0, b更近时返回1
+func (id NodeID) Compare(a, b NodeID) int {
+	da := id.Distance(a)
+	db := id.Distance(b)
+	return bytes.Compare(da[:], db[:])
+}
+
+// Less a比b离id更近, 用于按到id的距离排序
+func (id NodeID) Less(a, b NodeID) bool {
+	return id.Compare(a, b) < 0
+}
+
+// closer a比b离target更近时返回true
+func closer(target, a, b [20]byte) bool {
+	return NodeID(target).Less(a, b)
+}
+
+// commonPrefixLen a与b相同的前缀位数, 相同时为160
+func commonPrefixLen(a, b [20]byte) int {
+	return NodeID(a).CommonPrefixLen(b)
+}
@@ -0,0 +1,114 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// hexID 以hex开头, 其余补0的id
+func hexID(t *testing.T, prefix string) NodeID {
+	t.Helper()
+	b, err := hex.DecodeString(prefix + strings.Repeat("0", 40-len(prefix)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id NodeID
+	copy(id[:], b)
+	return id
+}
+
+func TestNodeIDDistance(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+		prefix     int
+	}{
+		{"", "", "", 160},
+		{"", strings.Repeat("f", 40), strings.Repeat("f", 40), 0},
+		{"0f0f", "f0f0", "ffff", 0},
+		{"80", "", "80", 0},
+		{"40", "", "40", 1},
+		{"01", "", "01", 7},
+		{"ffff", "fffe", "0001", 15},
+		{"123456", "123457", "000001", 23},
+		{strings.Repeat("0", 39) + "1", "", strings.Repeat("0", 39) + "1", 159},
+	}
+	for _, tt := range tests {
+		a, b := hexID(t, tt.a), hexID(t, tt.b)
+		if got := a.Distance(b); got != hexID(t, tt.want) {
+			t.Errorf("%s ^ %s = %s, want %s", a, b, got, hexID(t, tt.want))
+		}
+		if got := b.Distance(a); got != hexID(t, tt.want) {
+			t.Errorf("distance not symmetric for %s, %s", a, b)
+		}
+		if got := a.CommonPrefixLen(b); got != tt.prefix {
+			t.Errorf("CommonPrefixLen(%s, %s) = %d, want %d", a, b, got, tt.prefix)
+		}
+	}
+}
+
+func TestNodeIDCompare(t *testing.T) {
+	tests := []struct {
+		target, a, b string
+		want         int
+	}{
+		{"", "01", "02", -1},
+		{"", "02", "01", 1},
+		{"", "ff", "ff", 0},
+		//距离看xor, 不看数值大小
+		{strings.Repeat("f", 40), strings.Repeat("f", 39) + "e", "", -1},
+		{"80", "7f", "81", 1},
+	}
+	for _, tt := range tests {
+		target, a, b := hexID(t, tt.target), hexID(t, tt.a), hexID(t, tt.b)
+		if got := target.Compare(a, b); got != tt.want {
+			t.Errorf("Compare(%s, %s) to %s = %d, want %d", a, b, target, got, tt.want)
+		}
+		if got := target.Less(a, b); got != (tt.want < 0) {
+			t.Errorf("Less(%s, %s) to %s = %v", a, b, target, got)
+		}
+	}
+
+	target := hexID(t, "8000")
+	ids := []NodeID{hexID(t, "00"), hexID(t, "ff"), hexID(t, "8001"), hexID(t, "8000"), hexID(t, "c0")}
+	sort.Slice(ids, func(i, j int) bool { return target.Less(ids[i], ids[j]) })
+	want := []string{"8000", "8001", "c0", "ff", "00"}
+	for i, id := range ids {
+		if id != hexID(t, want[i]) {
+			t.Fatalf("sorted[%d] = %s, want %s", i, id, hexID(t, want[i]))
+		}
+	}
+}
+
+// BEP 42中的测试向量, 只有前21位和最后一个字节由ip和rand决定
+func TestSecureNodeIDVectors(t *testing.T) {
+	tests := []struct {
+		ip     string
+		rand   byte
+		prefix string
+	}{
+		{"124.31.75.21", 1, "5fbfbf"},
+		{"21.75.31.124", 86, "5a3ce9"},
+		{"65.23.51.170", 22, "a5d432"},
+		{"84.124.73.14", 65, "1b0321"},
+		{"43.213.53.83", 90, "e56f6c"},
+	}
+	for _, tt := range tests {
+		var id [20]byte
+		id[19] = tt.rand
+		got := secureNodeID(net.ParseIP(tt.ip).To4(), id)
+		want := hexID(t, tt.prefix)
+		if got[0] != want[0] || got[1] != want[1] || got[2]&0xf8 != want[2]&0xf8 {
+			t.Errorf("%s rand %d: id %x, want prefix %s", tt.ip, tt.rand, got, tt.prefix)
+		}
+		if got[19] != tt.rand {
+			t.Errorf("%s: last byte %d, want %d", tt.ip, got[19], tt.rand)
+		}
+	}
+
+	if _, err := GenerateSecureNodeID(net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("generated a secure id from an ipv6 address")
+	}
+}
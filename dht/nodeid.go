@@ -0,0 +1,88 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+func GenerateNodeID() [20]byte {
+	var id [20]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// GenerateNodeIDWithPrefix 生成以prefix开头的随机id, prefix超过20字节时只取前20字节
+//
+// 多台机器分工爬取时每个实例使用不同的前缀(配合WithNodeIDPrefix), 例如4个实例分别用
+// []byte{0x00}, []byte{0x40}, []byte{0x80}, []byte{0xc0}, 各自位于160位空间的四分之一处,
+// 其它节点查找附近的infohash时会查询到对应实例, 实例之间重复收集的infohash很少
+func GenerateNodeIDWithPrefix(prefix []byte) [20]byte {
+	id := GenerateNodeID()
+	copy(id[:], prefix)
+	return id
+}
+
+// GenerateSecureNodeID 按BEP 42由外网ipv4地址生成节点id, 前21位由ip的crc32c决定
+func GenerateSecureNodeID(ip net.IP) ([20]byte, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return [20]byte{}, errors.New("only ipv4 supported")
+	}
+	return secureNodeID(ip4, GenerateNodeID()), nil
+}
+
+// secureNodeID 用id最后一个字节作为BEP 42中的rand, 替换id的前21位
+func secureNodeID(ip4 net.IP, id [20]byte) [20]byte {
+	r := id[19] & 0x07
+	masked := []byte{ip4[0] & 0x03, ip4[1] & 0x0f, ip4[2] & 0x3f, ip4[3] & 0xff}
+	masked[0] |= r << 5
+	crc := crc32.Checksum(masked, crc32.MakeTable(crc32.Castagnoli))
+
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+	return id
+}
+
+// SaveNodeID 以hex文本保存节点id
+func SaveNodeID(path string, id [20]byte) error {
+	return ioutil.WriteFile(path, []byte(hex.EncodeToString(id[:])+"\n"), 0644)
+}
+
+func LoadNodeID(path string) ([20]byte, error) {
+	var id [20]byte
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return id, err
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return id, err
+	}
+	if len(b) != 20 {
+		return id, errors.New("node id length error")
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// loadOrCreateNodeID 从path读取节点id, 文件不存在时生成并保存
+func loadOrCreateNodeID(path string) ([20]byte, error) {
+	id, err := LoadNodeID(path)
+	if err == nil {
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return id, err
+	}
+	id = GenerateNodeID()
+	return id, SaveNodeID(path, id)
+}
@@ -0,0 +1,252 @@
+package dht
+
+import (
+	"DHTsimple/common"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type Option func(*DHT)
+
+// WithBootstrapNodes 启动时使用的路由节点, 按顺序优先使用
+func WithBootstrapNodes(nodes []string) Option {
+	return func(d *DHT) {
+		d.routers = newRouters(nodes)
+	}
+}
+
+// WithTargetStrategy find_node查询目标的生成方式, 默认UniformTargets
+func WithTargetStrategy(s TargetStrategy) Option {
+	return func(d *DHT) {
+		d.targets = s
+	}
+}
+
+func WithNodeID(id [20]byte) Option {
+	return func(d *DHT) {
+		d.Id = string(id[:])
+		d.idSet = true
+	}
+}
+
+// WithNodeIDFile 从文件读取节点id, 文件不存在时生成并保存, 重启后id不变
+func WithNodeIDFile(path string) Option {
+	return func(d *DHT) {
+		id, err := loadOrCreateNodeID(path)
+		if err != nil {
+			fmt.Printf("load node id from %s err:%s\n", path, err.Error())
+			return
+		}
+		d.Id = string(id[:])
+		d.idSet = true
+	}
+}
+
+// WithAlpha 迭代查询每轮的并发数, 默认3, 爬虫可以调大以换取速度
+func WithAlpha(alpha int) Option {
+	return func(d *DHT) {
+		if alpha <= 0 {
+			fmt.Printf("invalid alpha %d, use %d\n", alpha, defaultAlpha)
+			return
+		}
+		d.alpha = alpha
+	}
+}
+
+// WithK k桶大小, 同时也是迭代查询时考虑的最近节点数, 默认8
+func WithK(k int) Option {
+	return func(d *DHT) {
+		if k <= 0 {
+			fmt.Printf("invalid k %d, use %d\n", k, defaultK)
+			return
+		}
+		d.k = k
+	}
+}
+
+// WithQueryTimeout 每次发送查询后等待响应的时间, 默认3秒
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(d *DHT) {
+		if timeout <= 0 {
+			fmt.Printf("invalid query timeout %s, use %s\n", timeout, defaultQueryTimeout)
+			return
+		}
+		d.queryTimeout = timeout
+	}
+}
+
+// WithRetransmits 查询超时后的重发次数, 0为不重发, 默认1
+func WithRetransmits(n int) Option {
+	return func(d *DHT) {
+		if n < 0 {
+			fmt.Printf("invalid retransmits %d, use %d\n", n, defaultRetransmits)
+			return
+		}
+		d.retransmits = n
+	}
+}
+
+// WithExternalIP 我们的外网ip, 路由表不会加入该ip上的节点
+// 没有用WithNodeID等选项指定id时, 按BEP 42由ipv4地址生成节点id
+func WithExternalIP(ip net.IP) Option {
+	return func(d *DHT) {
+		d.externalIP = ip
+	}
+}
+
+// WithClock 替换路由表, peer存储, 路由节点健康检查和查询超时使用的时间来源
+func WithClock(c common.Clock) Option {
+	return func(d *DHT) {
+		d.clock = c
+	}
+}
+
+// WithFakeTokens 为true时token不对的announce_peer仍然发送到Sniffer.C, 适合爬虫, NewSniffer默认开启;
+// 无论是否开启, 只有带着我们在get_peers中发出的token的peer才会保存到peer存储
+func WithFakeTokens(fake bool) Option {
+	return func(d *DHT) {
+		d.fakeTokens = fake
+	}
+}
+
+// WithIpQueryLimit 每个来源ip每秒最多处理perSecond个查询, 超出的直接丢弃
+func WithIpQueryLimit(perSecond float64, burst int) Option {
+	return func(d *DHT) {
+		if perSecond <= 0 || burst <= 0 {
+			d.ipLimiter = nil
+			return
+		}
+		d.ipLimiter = newIpLimiter(perSecond, burst, d.clock)
+	}
+}
+
+// WithGlobalQueryLimit 所有来源合计每秒最多处理perSecond个查询
+func WithGlobalQueryLimit(perSecond float64, burst int) Option {
+	return func(d *DHT) {
+		if perSecond <= 0 || burst <= 0 {
+			d.queryLimiter = nil
+			return
+		}
+		d.queryLimiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+	}
+}
+
+// WithSniffDedup window内同一个infohash只发送到Sniffer.C一次, 0为不去重
+func WithSniffDedup(window time.Duration) Option {
+	return func(d *DHT) {
+		if window <= 0 {
+			d.dedup = nil
+			return
+		}
+		d.dedup = &sniffDedup{window: window, seen: make(map[sniffKey]time.Time)}
+	}
+}
+
+// WithPeerStore announce_peer宣告的peer保存ttl时间, 最多保存maxHashes个infohash, 每个最多maxPerHash个peer
+func WithPeerStore(ttl time.Duration, maxHashes int, maxPerHash int) Option {
+	return func(d *DHT) {
+		if ttl <= 0 {
+			fmt.Printf("invalid peer ttl %s, use %s\n", ttl, peerTTL)
+			ttl = peerTTL
+		}
+		d.peers = NewPeerStore(ttl, maxHashes, maxPerHash)
+	}
+}
+
+// WithSendLimiter 每次发送udp包前还要从l取得令牌, l可以与metadata下载共享(见common.NewLimiter)
+func WithSendLimiter(l *rate.Limiter) Option {
+	return func(d *DHT) {
+		d.sendLimiter = l
+	}
+}
+
+// WithNodeIDPrefix 使用以prefix开头的随机节点id, 分布式爬取时每个实例使用不同的前缀覆盖不同的区域
+func WithNodeIDPrefix(prefix []byte) Option {
+	return func(d *DHT) {
+		id := GenerateNodeIDWithPrefix(prefix)
+		d.Id = string(id[:])
+		d.idSet = true
+	}
+}
+
+// WithMaxLookupQueries LookupPeers一次最多查询的节点数, 默认64
+func WithMaxLookupQueries(n int) Option {
+	return func(d *DHT) {
+		if n <= 0 {
+			fmt.Printf("invalid max lookup queries %d, use %d\n", n, defaultMaxQueries)
+			return
+		}
+		d.maxQueries = n
+	}
+}
+
+// WithListenAddr 绑定的udp地址, 如":6881", 默认为配置中的host, 端口为0时由系统分配
+func WithListenAddr(addr string) Option {
+	return func(d *DHT) {
+		d.Host = addr
+	}
+}
+
+// WithReadOnly BEP 43只读模式, 查询中带上ro=1让其它节点不把我们加入路由表, 也不响应收到的查询
+func WithReadOnly(ro bool) Option {
+	return func(d *DHT) {
+		d.readOnly = ro
+	}
+}
+
+// WithPreferResponsive 从路由表选择节点时, 距离相近的节点中优先选择超时少, RTT低的
+func WithPreferResponsive() Option {
+	return func(d *DHT) {
+		d.preferResponsive = true
+	}
+}
+
+// WithRoutingTableFile Close时把路由表保存到path, Start时向保存的节点发送find_node, 重启后不必只依赖路由节点
+func WithRoutingTableFile(path string) Option {
+	return func(d *DHT) {
+		d.tableFile = path
+	}
+}
+
+// WithKeyspaceFilter 只爬取前bits位与prefix相同的区域: find_node的目标限制在区域内,
+// 区域外的infohash不发送到Sniffer.C, 不保存peer也不交给metadata下载, 见WithKeyspaceForward.
+// 配合WithNodeIDPrefix使用, N台机器用不相交的前缀即可分工覆盖整个空间
+func WithKeyspaceFilter(prefix []byte, bits int) Option {
+	return func(d *DHT) {
+		if bits < 0 || bits > 160 || len(prefix)*8 < bits {
+			fmt.Printf("invalid keyspace filter %x/%d, ignored\n", prefix, bits)
+			return
+		}
+		var forward func(Sniffed)
+		if d.keyspace != nil {
+			forward = d.keyspace.forward
+		}
+		d.keyspace = &keyspace{bits: bits, forward: forward}
+		copy(d.keyspace.prefix[:], prefix)
+	}
+}
+
+// WithKeyspaceForward 设置WithKeyspaceFilter后, 区域外的infohash交给fn, 例如转发给负责该区域的实例
+// fn在处理查询的goroutine中调用, 不应阻塞
+func WithKeyspaceForward(fn func(Sniffed)) Option {
+	return func(d *DHT) {
+		if d.keyspace == nil {
+			d.keyspace = &keyspace{}
+		}
+		d.keyspace.forward = fn
+	}
+}
+
+// WithTimerJitter 刷新, 维护, 过期等周期定时器的随机抖动比例, 默认0.1即±10%, 0为不抖动
+func WithTimerJitter(frac float64) Option {
+	return func(d *DHT) {
+		if frac < 0 || frac >= 1 {
+			fmt.Printf("invalid timer jitter %v, use %v\n", frac, common.DefaultJitter)
+			return
+		}
+		d.jitter = frac
+	}
+}
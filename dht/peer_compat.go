@@ -0,0 +1,11 @@
+//go:build !go1.18
+// +build !go1.18
+
+package dht
+
+import "DHTsimple/load"
+
+// decodeValues go1.18之前没有net/netip, 使用ParseCompactPeers
+func decodeValues(s string) ([]string, error) {
+	return load.ParseCompactPeers([]byte(s), len(s) == 18)
+}
@@ -0,0 +1,19 @@
+//go:build go1.18
+// +build go1.18
+
+package dht
+
+import "DHTsimple/load"
+
+// decodeValues 解析get_peers响应values中的一项, 6字节为ipv4, 18字节为ipv6
+func decodeValues(s string) ([]string, error) {
+	decode := load.DecodeCompactPeers
+	if len(s) == 18 {
+		decode = load.DecodeCompactPeers6
+	}
+	peers, err := decode([]byte(s))
+	if err != nil {
+		return nil, err
+	}
+	return load.PeerAddrs(peers), nil
+}
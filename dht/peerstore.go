@@ -0,0 +1,172 @@
+package dht
+
+import (
+	"DHTsimple/common"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	peerTTL        = 30 * time.Minute
+	maxPeersPerKey = 100
+	maxPeerHashes  = 100000
+)
+
+// PeerStore 保存announce_peer宣告的peer, 用于响应get_peers, 超过ttl的peer失效
+type PeerStore struct {
+	lock       sync.Mutex
+	ttl        time.Duration
+	maxHashes  int
+	maxPerHash int
+	clock      common.Clock
+	peers      map[[20]byte]map[string]time.Time
+}
+
+// NewPeerStore maxHashes为最多保存的infohash数, maxPerHash为每个infohash最多保存的peer数, 0为不限制
+func NewPeerStore(ttl time.Duration, maxHashes int, maxPerHash int) *PeerStore {
+	return &PeerStore{
+		ttl:        ttl,
+		maxHashes:  maxHashes,
+		maxPerHash: maxPerHash,
+		clock:      common.RealClock,
+		peers:      make(map[[20]byte]map[string]time.Time),
+	}
+}
+
+func (s *PeerStore) SetClock(c common.Clock) {
+	s.lock.Lock()
+	s.clock = c
+	s.lock.Unlock()
+}
+
+func (s *PeerStore) Announce(infoHash [20]byte, addr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.clock.Now()
+	set, ok := s.peers[infoHash]
+	if !ok {
+		if s.maxHashes > 0 && len(s.peers) >= s.maxHashes {
+			s.evictHash(now)
+		}
+		set = make(map[string]time.Time)
+		s.peers[infoHash] = set
+	}
+	if _, ok := set[addr]; !ok && s.maxPerHash > 0 && len(set) >= s.maxPerHash {
+		//满了先删除过期的, 仍然满则替换最早过期的
+		oldest := ""
+		for a, expires := range set {
+			if now.After(expires) {
+				delete(set, a)
+			} else if oldest == "" || expires.Before(set[oldest]) {
+				oldest = a
+			}
+		}
+		if len(set) >= s.maxPerHash {
+			delete(set, oldest)
+		}
+	}
+	set[addr] = now.Add(s.ttl)
+}
+
+// evictHash infohash数量满时腾出一个位置, 在随机抽取的几个中优先删除peer都已过期的, 否则删除第一个, 调用时需持有锁
+func (s *PeerStore) evictHash(now time.Time) {
+	var victim [20]byte
+	checked := 0
+	for hash, set := range s.peers {
+		if checked == 0 {
+			victim = hash
+		}
+		if checked++; checked > 16 {
+			break
+		}
+		expired := true
+		for _, expires := range set {
+			if !now.After(expires) {
+				expired = false
+				break
+			}
+		}
+		if expired {
+			delete(s.peers, hash)
+			return
+		}
+	}
+	if checked > 0 {
+		delete(s.peers, victim)
+	}
+}
+
+// Peers 最多返回max个未过期的peer
+func (s *PeerStore) Peers(infoHash [20]byte, max int) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.clock.Now()
+	var ret []string
+	for addr, expires := range s.peers[infoHash] {
+		if now.After(expires) {
+			delete(s.peers[infoHash], addr)
+			continue
+		}
+		if len(ret) < max {
+			ret = append(ret, addr)
+		}
+	}
+	if set, ok := s.peers[infoHash]; ok && len(set) == 0 {
+		delete(s.peers, infoHash)
+	}
+	return ret
+}
+
+// Expire 清理所有过期的peer
+func (s *PeerStore) Expire() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.clock.Now()
+	for hash, set := range s.peers {
+		for addr, expires := range set {
+			if now.After(expires) {
+				delete(set, addr)
+			}
+		}
+		if len(set) == 0 {
+			delete(s.peers, hash)
+		}
+	}
+}
+
+// Count 所有infohash的peer总数, 包括尚未清理的过期peer
+func (s *PeerStore) Count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for _, set := range s.peers {
+		n += len(set)
+	}
+	return n
+}
+
+func (s *PeerStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.peers)
+}
+
+// encodeCompactPeer ipv4 peer编码为6字节, 不是ipv4时返回空
+func encodeCompactPeer(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host).To4()
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return ""
+	}
+	b := make([]byte, 6)
+	copy(b, ip)
+	binary.BigEndian.PutUint16(b[4:], uint16(p))
+	return string(b)
+}
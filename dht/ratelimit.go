@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"DHTsimple/common"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ipLimiter 按来源ip限制收到的查询速率
+type ipLimiter struct {
+	lock     sync.Mutex
+	limit    rate.Limit
+	burst    int
+	clock    common.Clock
+	limiters map[string]*ipEntry
+}
+
+type ipEntry struct {
+	limiter *rate.Limiter
+	last    time.Time
+}
+
+func newIpLimiter(perSecond float64, burst int, clock common.Clock) *ipLimiter {
+	return &ipLimiter{
+		limit:    rate.Limit(perSecond),
+		burst:    burst,
+		clock:    clock,
+		limiters: make(map[string]*ipEntry),
+	}
+}
+
+func (l *ipLimiter) allow(ip string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	e, ok := l.limiters[ip]
+	if !ok {
+		e = &ipEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = e
+	}
+	e.last = now
+	return e.limiter.AllowN(now, 1)
+}
+
+// expire 删除idle时间内没有查询的ip
+func (l *ipLimiter) expire(idle time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	for ip, e := range l.limiters {
+		if now.Sub(e.last) > idle {
+			delete(l.limiters, ip)
+		}
+	}
+}
+
+// allowQuery 全局和来源ip的限速都通过才处理该查询, 否则直接丢弃
+func (d *DHT) allowQuery(ip string) bool {
+	if d.queryLimiter != nil && !d.queryLimiter.AllowN(d.clock.Now(), 1) {
+		return false
+	}
+	if d.ipLimiter != nil && !d.ipLimiter.allow(ip) {
+		return false
+	}
+	return true
+}
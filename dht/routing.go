@@ -0,0 +1,513 @@
+package dht
+
+import (
+	"DHTsimple/common"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	idBits = 160
+	//超过这段时间没有响应的节点在桶满时可以被替换
+	staleAfter = 15 * time.Minute
+	//连续超时这么多次的节点视为坏节点
+	maxNodeFails = 2
+	//ping可疑节点的周期
+	maintenanceInterval = 5 * time.Minute
+	//等待回调处理的节点变化数, 回调太慢时新的变化被丢弃
+	nodeEventBuf = 1024
+)
+
+// Table 路由表接口, 便于以后替换为持久化的实现
+type Table interface {
+	Insert(node Node) bool
+	Remove(id [20]byte)
+	Closest(target [20]byte, n int) []Node
+	Len() int
+}
+
+type bucket struct {
+	//按最后响应时间排序, 最旧的在前
+	nodes   []*Node
+	changed time.Time
+}
+
+// RoutingTable 以我们的节点id为中心的160个k桶
+type RoutingTable struct {
+	lock    sync.RWMutex
+	self    [20]byte
+	k       int
+	buckets [idBits]*bucket
+	//节点地址到id, 同一个地址只保存一个id
+	addrs map[string][20]byte
+	//我们自己的地址, 不加入路由表
+	selfAddr   *net.UDPAddr
+	externalIP net.IP
+	clock      common.Clock
+	jitter     float64
+
+	onAdded   func(Node)
+	onRemoved func(Node)
+	events    chan nodeEvent
+}
+
+type nodeEvent struct {
+	node  Node
+	added bool
+}
+
+func NewRoutingTable(self [20]byte, k int) *RoutingTable {
+	t := &RoutingTable{self: self, k: k, addrs: make(map[string][20]byte), clock: common.RealClock, jitter: common.DefaultJitter}
+	for i := range t.buckets {
+		t.buckets[i] = &bucket{}
+	}
+	return t
+}
+
+// bucketIndex 与我们id的公共前缀长度, id与我们相同时返回idBits
+func (t *RoutingTable) bucketIndex(id [20]byte) int {
+	return commonPrefixLen(t.self, id)
+}
+
+func (t *RoutingTable) SetClock(c common.Clock) {
+	t.lock.Lock()
+	t.clock = c
+	t.lock.Unlock()
+}
+
+// SetJitter 维护周期的抖动比例, 默认为common.DefaultJitter
+func (t *RoutingTable) SetJitter(frac float64) {
+	t.lock.Lock()
+	t.jitter = frac
+	t.lock.Unlock()
+}
+
+// SetSelfAddr 我们监听的地址, 与之相同的节点不加入路由表
+func (t *RoutingTable) SetSelfAddr(addr *net.UDPAddr) {
+	t.lock.Lock()
+	t.selfAddr = addr
+	t.lock.Unlock()
+}
+
+// SetExternalIP 我们的外网ip, 该ip上的节点不加入路由表
+func (t *RoutingTable) SetExternalIP(ip net.IP) {
+	t.lock.Lock()
+	t.externalIP = ip
+	t.lock.Unlock()
+}
+
+// isSelf 调用时需持有锁
+func (t *RoutingTable) isSelf(addr *net.UDPAddr) bool {
+	if t.externalIP != nil && addr.IP.Equal(t.externalIP) {
+		return true
+	}
+	return t.selfAddr != nil && addr.Port == t.selfAddr.Port && addr.IP.Equal(t.selfAddr.IP)
+}
+
+// Insert 新节点或已有节点有了响应时调用, 桶满且没有过期节点时丢弃新节点
+// 我们自己的id或地址, 以及已用其它id保存过的地址都会被拒绝
+func (t *RoutingTable) Insert(node Node) bool {
+	index := t.bucketIndex(node.Id)
+	if index >= idBits || node.Addr == nil {
+		return false
+	}
+	addr := node.Addr.String()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.clock.Now()
+	if node.LastSeen.IsZero() {
+		node.LastSeen = now
+	}
+	if t.isSelf(node.Addr) {
+		return false
+	}
+	if id, ok := t.addrs[addr]; ok && id != node.Id {
+		return false
+	}
+
+	b := t.buckets[index]
+	for i, n := range b.nodes {
+		if n.Id == node.Id {
+			if n.Addr.String() != addr {
+				//同一id换了地址, 保留原来的
+				return false
+			}
+			if node.RTT > 0 {
+				node.RTT = rttEma(n.RTT, node.RTT)
+			} else {
+				node.RTT = n.RTT
+			}
+			b.nodes = append(b.nodes[:i], b.nodes[i+1:]...)
+			b.nodes = append(b.nodes, &node)
+			b.changed = node.LastSeen
+			return true
+		}
+	}
+
+	if len(b.nodes) >= t.k {
+		if b.nodes[0].Fails < maxNodeFails && now.Sub(b.nodes[0].LastSeen) < staleAfter {
+			return false
+		}
+		delete(t.addrs, b.nodes[0].Addr.String())
+		t.notify(*b.nodes[0], false)
+		b.nodes = b.nodes[1:]
+	}
+	t.addrs[addr] = node.Id
+	b.nodes = append(b.nodes, &node)
+	b.changed = node.LastSeen
+	t.notify(node, true)
+	return true
+}
+
+func (t *RoutingTable) Remove(id [20]byte) {
+	index := t.bucketIndex(id)
+	if index >= idBits {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	b := t.buckets[index]
+	for i, n := range b.nodes {
+		if n.Id == id {
+			delete(t.addrs, n.Addr.String())
+			b.nodes = append(b.nodes[:i], b.nodes[i+1:]...)
+			t.notify(*n, false)
+			return
+		}
+	}
+}
+
+// OnNodeAdded 新节点加入路由表时调用fn, 已有节点的更新不调用
+// 回调在单独的goroutine中按顺序执行, 不会阻塞路由表, 处理不过来时丢弃变化
+func (t *RoutingTable) OnNodeAdded(fn func(Node)) {
+	t.lock.Lock()
+	t.onAdded = fn
+	t.startEvents()
+	t.lock.Unlock()
+}
+
+// OnNodeRemoved 节点被移除或在桶满时被替换时调用fn, 执行方式与OnNodeAdded相同
+func (t *RoutingTable) OnNodeRemoved(fn func(Node)) {
+	t.lock.Lock()
+	t.onRemoved = fn
+	t.startEvents()
+	t.lock.Unlock()
+}
+
+// startEvents 调用时需持有锁
+func (t *RoutingTable) startEvents() {
+	if t.events != nil {
+		return
+	}
+	t.events = make(chan nodeEvent, nodeEventBuf)
+	go t.dispatch(t.events)
+}
+
+func (t *RoutingTable) dispatch(events chan nodeEvent) {
+	for ev := range events {
+		t.lock.RLock()
+		fn := t.onRemoved
+		if ev.added {
+			fn = t.onAdded
+		}
+		t.lock.RUnlock()
+		if fn != nil {
+			fn(ev.node)
+		}
+	}
+}
+
+// notify 调用时需持有锁
+func (t *RoutingTable) notify(node Node, added bool) {
+	if t.events == nil {
+		return
+	}
+	select {
+	case t.events <- nodeEvent{node: node, added: added}:
+	default:
+	}
+}
+
+// StopEvents 停止调用OnNodeAdded/OnNodeRemoved设置的回调
+func (t *RoutingTable) StopEvents() {
+	t.lock.Lock()
+	if t.events != nil {
+		close(t.events)
+		t.events = nil
+	}
+	t.lock.Unlock()
+}
+
+// Failed 记录对addr的查询超时, 返回该节点连续超时的次数, 不在路由表中时返回0
+func (t *RoutingTable) Failed(addr *net.UDPAddr) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	id, ok := t.addrs[addr.String()]
+	if !ok {
+		return 0
+	}
+	for _, n := range t.buckets[t.bucketIndex(id)].nodes {
+		if n.Id == id {
+			n.Fails++
+			return n.Fails
+		}
+	}
+	return 0
+}
+
+// fails addr上的节点连续超时的次数, 不在路由表中时返回0
+func (t *RoutingTable) fails(addr *net.UDPAddr) int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	id, ok := t.addrs[addr.String()]
+	if !ok {
+		return 0
+	}
+	for _, n := range t.buckets[t.bucketIndex(id)].nodes {
+		if n.Id == id {
+			return n.Fails
+		}
+	}
+	return 0
+}
+
+// States 按BEP 5的节点状态统计: staleAfter内有响应的为good, 连续超时maxNodeFails次的为bad, 其余为questionable
+func (t *RoutingTable) States() (good, questionable, bad int) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	now := t.clock.Now()
+	for _, b := range t.buckets {
+		for _, n := range b.nodes {
+			switch {
+			case n.Fails >= maxNodeFails:
+				bad++
+			case now.Sub(n.LastSeen) < staleAfter:
+				good++
+			default:
+				questionable++
+			}
+		}
+	}
+	return
+}
+
+// Pinger 维护路由表时用来ping节点, DHT实现了该接口
+// 超时时实现应该调用RoutingTable.Failed记录, DHT的所有查询都会这样做
+type Pinger interface {
+	Ping(node string) ([20]byte, error)
+}
+
+// StartMaintenance 每隔interval ping一次超过staleAfter没有响应的节点,
+// 响应的节点刷新最后响应时间, 连续maxNodeFails次没有响应的节点被移除,
+// 调用返回的函数停止维护, 等正在进行的一轮结束后返回
+func (t *RoutingTable) StartMaintenance(client Pinger, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	t.lock.RLock()
+	jitter := t.jitter
+	t.lock.RUnlock()
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.clock.After(common.JitteredInterval(interval, jitter)):
+				t.maintain(client)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}
+}
+
+func (t *RoutingTable) questionable() []Node {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	now := t.clock.Now()
+	var ret []Node
+	for _, b := range t.buckets {
+		for _, n := range b.nodes {
+			if now.Sub(n.LastSeen) >= staleAfter {
+				ret = append(ret, *n)
+			}
+		}
+	}
+	return ret
+}
+
+func (t *RoutingTable) maintain(client Pinger) {
+	for _, n := range t.questionable() {
+		id, err := client.Ping(n.Addr.String())
+		if err == nil && id == n.Id {
+			t.Insert(Node{Id: n.Id, Addr: n.Addr})
+			continue
+		}
+		if err == nil {
+			//地址上换了一个节点
+			t.Remove(n.Id)
+			t.Insert(Node{Id: id, Addr: n.Addr})
+			continue
+		}
+		if t.fails(n.Addr) >= maxNodeFails {
+			t.Remove(n.Id)
+		}
+	}
+}
+
+// Closest 按与target的xor距离返回最近的n个节点
+func (t *RoutingTable) Closest(target [20]byte, n int) []Node {
+	t.lock.RLock()
+	var all []Node
+	for _, b := range t.buckets {
+		for _, node := range b.nodes {
+			all = append(all, *node)
+		}
+	}
+	t.lock.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return closer(target, all[i].Id, all[j].Id)
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// ClosestResponsive 与Closest相同, 但与target公共前缀长度相同的节点之间先按超时次数再按RTT排序,
+// 距离相近时优先选择响应快的节点
+func (t *RoutingTable) ClosestResponsive(target [20]byte, n int) []Node {
+	t.lock.RLock()
+	var all []Node
+	for _, b := range t.buckets {
+		for _, node := range b.nodes {
+			all = append(all, *node)
+		}
+	}
+	t.lock.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		pa, pb := commonPrefixLen(target, a.Id), commonPrefixLen(target, b.Id)
+		if pa != pb {
+			return pa > pb
+		}
+		if a.Fails != b.Fails {
+			return a.Fails < b.Fails
+		}
+		if (a.RTT == 0) != (b.RTT == 0) {
+			return a.RTT != 0
+		}
+		if a.RTT != b.RTT {
+			return a.RTT < b.RTT
+		}
+		return closer(target, a.Id, b.Id)
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func (t *RoutingTable) Len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b.nodes)
+	}
+	return n
+}
+
+// RefreshTargets 对age时间内没有变化的非空桶, 各返回一个落在该桶内的随机id, 用于find_node刷新
+func (t *RoutingTable) RefreshTargets(age time.Duration) [][20]byte {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	now := t.clock.Now()
+	var ret [][20]byte
+	for i, b := range t.buckets {
+		if len(b.nodes) == 0 || now.Sub(b.changed) < age {
+			continue
+		}
+		ret = append(ret, randomIdInBucket(t.self, i))
+	}
+	return ret
+}
+
+// randomIdInBucket 与self前index位相同, 第index位不同的随机id
+func randomIdInBucket(self [20]byte, index int) [20]byte {
+	id := GenerateNodeID()
+	for i := 0; i < index; i++ {
+		setBit(&id, i, bit(self, i))
+	}
+	setBit(&id, index, bit(self, index)^1)
+	return id
+}
+
+func bit(id [20]byte, i int) byte {
+	return id[i/8] >> (7 - uint(i%8)) & 1
+}
+
+func setBit(id *[20]byte, i int, v byte) {
+	mask := byte(1) << (7 - uint(i%8))
+	if v == 0 {
+		id[i/8] &^= mask
+	} else {
+		id[i/8] |= mask
+	}
+}
+
+// refreshLoop 定期向刷新目标附近的节点发送find_node, 响应的节点会加入路由表
+func (d *DHT) refreshLoop() {
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-d.clock.After(d.interval(5 * time.Minute)):
+		}
+		for _, target := range d.table.RefreshTargets(staleAfter) {
+			for _, node := range d.closest(target, d.alpha) {
+				req := common.MakeFindNode("find_node", d.Id, "", string(target[:]))
+				d.request(&FindNodeReq{Addr: node.Addr.String(), Req: req})
+			}
+		}
+	}
+}
+
+// seen 收到节点的响应时记录到路由表
+// rtt为我们的查询的往返时间, 爬虫的find_node响应没有测量时为0
+func (d *DHT) seen(r map[string]interface{}, addr *net.UDPAddr, rtt time.Duration) {
+	if addr == nil {
+		return
+	}
+	id, err := responseId(r)
+	if err != nil {
+		return
+	}
+	d.table.Insert(Node{Id: id, Addr: addr, RTT: rtt})
+}
+
+// OnNodeAdded 见RoutingTable.OnNodeAdded
+func (d *DHT) OnNodeAdded(fn func(Node)) {
+	d.table.OnNodeAdded(fn)
+}
+
+// OnNodeRemoved 见RoutingTable.OnNodeRemoved
+func (d *DHT) OnNodeRemoved(fn func(Node)) {
+	d.table.OnNodeRemoved(fn)
+}
+
+// closest 路由表中离target最近的n个节点, WithPreferResponsive时距离相近的优先选择响应快的
+func (d *DHT) closest(target [20]byte, n int) []Node {
+	if d.preferResponsive {
+		return d.table.ClosestResponsive(target, n)
+	}
+	return d.table.Closest(target, n)
+}
@@ -0,0 +1,146 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock Now只在advance时变化, After返回的通道由测试触发
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+	//每次After调用都把返回的通道发送到这里
+	timers chan chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1700000000, 0), timers: make(chan chan time.Time, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.timers <- ch
+	return ch
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.lock.Unlock()
+}
+
+// tick 触发下一个定时器, 并等待下一次After调用, 即这一轮处理完成
+func (c *fakeClock) tick(t *testing.T) {
+	t.Helper()
+	select {
+	case ch := <-c.timers:
+		ch <- c.Now()
+	case <-time.After(3 * time.Second):
+		t.Fatal("no timer waiting")
+	}
+	select {
+	case ch := <-c.timers:
+		//放回去给下一次tick
+		c.timers <- ch
+	case <-time.After(3 * time.Second):
+		t.Fatal("round did not finish")
+	}
+}
+
+// fakePinger 按地址返回预设的ping结果, 没有预设结果的地址像DHT.Ping一样记录超时
+type fakePinger struct {
+	lock    sync.Mutex
+	table   *RoutingTable
+	replies map[string][20]byte
+	pings   map[string]int
+}
+
+func (p *fakePinger) Ping(node string) ([20]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pings[node]++
+	id, ok := p.replies[node]
+	if !ok {
+		addr, _ := net.ResolveUDPAddr("udp", node)
+		p.table.Failed(addr)
+		return id, ErrQueryTimeout
+	}
+	return id, nil
+}
+
+func (p *fakePinger) count(node string) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.pings[node]
+}
+
+func TestStartMaintenance(t *testing.T) {
+	clock := newFakeClock()
+	table := NewRoutingTable(GenerateNodeID(), 8)
+	table.SetClock(clock)
+	table.SetJitter(0)
+
+	node := func(port int) Node {
+		return Node{Id: GenerateNodeID(), Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}}
+	}
+	alive, dead, moved, fresh := node(1), node(2), node(3), node(4)
+	newID := GenerateNodeID()
+	for _, n := range []Node{alive, dead, moved} {
+		table.Insert(n)
+	}
+	clock.advance(staleAfter + time.Minute)
+	//刚响应过的节点不需要ping
+	table.Insert(fresh)
+
+	client := &fakePinger{
+		table:   table,
+		replies: map[string][20]byte{alive.Addr.String(): alive.Id, moved.Addr.String(): newID},
+		pings:   make(map[string]int),
+	}
+	stop := table.StartMaintenance(client, time.Minute)
+	defer stop()
+
+	has := func(id [20]byte) bool {
+		for _, n := range table.Closest(id, 1) {
+			if n.Id == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	clock.tick(t)
+	if !has(alive.Id) || !has(fresh.Id) {
+		t.Fatal("responsive node removed")
+	}
+	if has(moved.Id) || !has(newID) {
+		t.Fatal("node answering with a new id not replaced")
+	}
+	//第一次超时只是可疑
+	if !has(dead.Id) {
+		t.Fatal("node removed after one failed ping")
+	}
+	if client.count(fresh.Addr.String()) != 0 {
+		t.Fatal("pinged a node heard from recently")
+	}
+
+	clock.tick(t)
+	if has(dead.Id) {
+		t.Fatalf("node still present after %d failed pings", maxNodeFails)
+	}
+	//alive在第一轮刷新过, 第二轮不再ping
+	if n := client.count(alive.Addr.String()); n != 1 {
+		t.Fatalf("alive pinged %d times, want 1", n)
+	}
+	if good, questionable, bad := table.States(); good != 3 || questionable != 0 || bad != 0 {
+		t.Fatalf("states good=%d questionable=%d bad=%d, want 3/0/0", good, questionable, bad)
+	}
+}
@@ -0,0 +1,96 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	//NewSniffer的默认限速
+	snifferIpRate      = 10
+	snifferIpBurst     = 20
+	snifferGlobalRate  = 2000
+	snifferGlobalBurst = 4000
+	//同一个infohash在这段时间内只发送一次
+	snifferDedupWindow = 5 * time.Minute
+)
+
+// Sniffed 从其它节点的查询中收集到的infohash
+type Sniffed struct {
+	InfoHash [20]byte
+	//get_peers或announce_peer
+	Query string
+	//发送查询的节点地址
+	Source string
+	//announce_peer宣告的peer地址, 可以直接用来获取metadata, get_peers时为空
+	Peer string
+}
+
+// Sniffer 被动爬虫, 只响应其它节点的查询来留在它们的路由表中,
+// 并把get_peers/announce_peer中出现的infohash发送到C
+type Sniffer struct {
+	*DHT
+	C <-chan Sniffed
+}
+
+// NewSniffer buf为C的缓冲长度, C满时新的infohash被丢弃
+// 默认对收到的查询按来源ip和全局限速, 并对infohash去重, 可以用opts覆盖
+func NewSniffer(buf int, opts ...Option) *Sniffer {
+	defaults := []Option{
+		WithIpQueryLimit(snifferIpRate, snifferIpBurst),
+		WithGlobalQueryLimit(snifferGlobalRate, snifferGlobalBurst),
+		WithSniffDedup(snifferDedupWindow),
+		WithFakeTokens(true),
+	}
+	d := NewDHT(append(defaults, opts...)...)
+	ch := make(chan Sniffed, buf)
+	d.sniffed = ch
+	return &Sniffer{DHT: d, C: ch}
+}
+
+// sniffDedup 记录最近发送过的infohash, announce_peer以infohash和peer地址为key,
+// 新的peer地址仍会发送
+type sniffDedup struct {
+	lock   sync.Mutex
+	window time.Duration
+	seen   map[sniffKey]time.Time
+}
+
+type sniffKey struct {
+	hash [20]byte
+	peer string
+}
+
+// first 窗口内第一次出现时返回true
+func (s *sniffDedup) first(k sniffKey, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if last, ok := s.seen[k]; ok && now.Sub(last) < s.window {
+		return false
+	}
+	s.seen[k] = now
+	return true
+}
+
+func (s *sniffDedup) expire(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, last := range s.seen {
+		if now.Sub(last) >= s.window {
+			delete(s.seen, k)
+		}
+	}
+}
+
+func (d *DHT) sniff(s Sniffed) {
+	if d.sniffed == nil {
+		return
+	}
+	if d.dedup != nil && !d.dedup.first(sniffKey{hash: s.InfoHash, peer: s.Peer}, d.clock.Now()) {
+		return
+	}
+	select {
+	case d.sniffed <- s:
+	default:
+	}
+}
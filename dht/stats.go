@@ -0,0 +1,67 @@
+package dht
+
+import (
+	"DHTsimple/load"
+	"sync"
+	"sync/atomic"
+)
+
+// counters 按查询类型计数
+type counters struct {
+	lock sync.Mutex
+	m    map[string]int64
+}
+
+func (c *counters) add(q string) {
+	c.lock.Lock()
+	if c.m == nil {
+		c.m = make(map[string]int64)
+	}
+	c.m[q]++
+	c.lock.Unlock()
+}
+
+func (c *counters) snapshot() map[string]int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ret := make(map[string]int64, len(c.m))
+	for k, v := range c.m {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Stats 节点运行状态的快照
+type Stats struct {
+	//路由表中的节点数及按状态的分布
+	Nodes             int
+	GoodNodes         int
+	QuestionableNodes int
+	BadNodes          int
+	//从收到的get_peers/announce_peer中发现的infohash次数
+	InfoHashes int64
+	//peer存储中的infohash数和peer数
+	StoredHashes int
+	StoredPeers  int
+	//按查询类型统计的发送和接收次数
+	QueriesSent     map[string]int64
+	QueriesReceived map[string]int64
+	//正在进行的metadata下载
+	InFlightFetches int
+}
+
+func (d *DHT) Stats() Stats {
+	good, questionable, bad := d.table.States()
+	return Stats{
+		Nodes:             good + questionable + bad,
+		GoodNodes:         good,
+		QuestionableNodes: questionable,
+		BadNodes:          bad,
+		InfoHashes:        atomic.LoadInt64(&d.infoHashes),
+		StoredHashes:      d.peers.Len(),
+		StoredPeers:       d.peers.Count(),
+		QueriesSent:       d.sent.snapshot(),
+		QueriesReceived:   d.received.snapshot(),
+		InFlightFetches:   load.InFlightFetches(),
+	}
+}
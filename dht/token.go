@@ -0,0 +1,83 @@
+package dht
+
+import (
+	"DHTsimple/common"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	//token密钥的轮换周期, 上一个密钥签发的token仍然有效, 所以token最长有效2个周期
+	tokenRotation = 5 * time.Minute
+	tokenLen      = 8
+)
+
+// tokens get_peers中签发给查询方的token, 为查询方ip与密钥的hmac
+type tokens struct {
+	lock     sync.Mutex
+	clock    common.Clock
+	current  []byte
+	previous []byte
+	rotated  time.Time
+}
+
+func newSecret() []byte {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return b
+}
+
+// rotate 到期时轮换密钥, 调用时需持有锁
+func (ts *tokens) rotate() {
+	now := ts.clock.Now()
+	if ts.current == nil {
+		ts.current, ts.previous, ts.rotated = newSecret(), newSecret(), now
+		return
+	}
+	elapsed := now.Sub(ts.rotated)
+	if elapsed < tokenRotation {
+		return
+	}
+	if elapsed >= 2*tokenRotation {
+		//超过两个周期没有使用, 之前签发的token都已失效
+		ts.previous = newSecret()
+	} else {
+		ts.previous = ts.current
+	}
+	ts.current, ts.rotated = newSecret(), now
+}
+
+func tokenFor(secret []byte, ip net.IP) []byte {
+	mac := hmac.New(sha1.New, secret)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mac.Write(ip)
+	return mac.Sum(nil)[:tokenLen]
+}
+
+func (ts *tokens) issue(ip net.IP) []byte {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.rotate()
+	return tokenFor(ts.current, ip)
+}
+
+func (ts *tokens) validate(token []byte, ip net.IP) bool {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.rotate()
+	return hmac.Equal(token, tokenFor(ts.current, ip)) || hmac.Equal(token, tokenFor(ts.previous, ip))
+}
+
+func (d *DHT) issueToken(ip net.IP) []byte {
+	return d.tokens.issue(ip)
+}
+
+func (d *DHT) validateToken(token []byte, ip net.IP) bool {
+	return d.tokens.validate(token, ip)
+}
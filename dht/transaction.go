@@ -0,0 +1,162 @@
+package dht
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/marksamman/bencode"
+)
+
+const (
+	//每次发送后等待响应的时间
+	defaultQueryTimeout = 3 * time.Second
+	//超时后用同一个t重发的次数
+	defaultRetransmits = 1
+)
+
+var (
+	ErrNotStarted   = errors.New("dht not started")
+	ErrQueryTimeout = errors.New("krpc query timeout")
+	ErrClosed       = errors.New("dht closed")
+)
+
+// transactions 等待响应的查询, key为t
+// 我们的查询使用4字节的随机t, 与爬虫find_node使用的2字节随机t不会冲突
+type transactions struct {
+	lock    sync.Mutex
+	pending map[string]*pendingQuery
+}
+
+// pendingQuery 记录查询发往的地址, 只接受从这个地址返回的响应
+type pendingQuery struct {
+	addr *net.UDPAddr
+	ch   chan map[string]interface{}
+}
+
+// add 为发往addr的查询分配一个未使用的随机t, 随机的t让伪造响应难以猜中
+func (ts *transactions) add(addr *net.UDPAddr) (string, chan map[string]interface{}) {
+	p := &pendingQuery{addr: addr, ch: make(chan map[string]interface{}, 1)}
+	b := make([]byte, 4)
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.pending == nil {
+		ts.pending = make(map[string]*pendingQuery)
+	}
+	for {
+		rand.Read(b)
+		t := string(b)
+		if _, ok := ts.pending[t]; !ok {
+			ts.pending[t] = p
+			return t, p.ch
+		}
+	}
+}
+
+func (ts *transactions) remove(t string) {
+	ts.lock.Lock()
+	delete(ts.pending, t)
+	ts.lock.Unlock()
+}
+
+// resolve 把响应交给对应的查询, 不是我们发出的查询或者来源地址不是查询发往的地址时返回false
+func (ts *transactions) resolve(t string, from *net.UDPAddr, msg map[string]interface{}) bool {
+	ts.lock.Lock()
+	p, ok := ts.pending[t]
+	if !ok || from == nil || !p.addr.IP.Equal(from.IP) || p.addr.Port != from.Port {
+		ts.lock.Unlock()
+		return false
+	}
+	delete(ts.pending, t)
+	ts.lock.Unlock()
+	p.ch <- msg
+	return true
+}
+
+// BEP 5定义的错误码
+const (
+	ErrCodeGeneric       = 201
+	ErrCodeServer        = 202
+	ErrCodeProtocol      = 203
+	ErrCodeMethodUnknown = 204
+)
+
+// KRPCError 对方返回的y为e的响应
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+// errorResponse 解析y为e的响应, e为[code, message], 格式不对时Code为0, Message为原始内容
+func errorResponse(resp map[string]interface{}) *KRPCError {
+	e, _ := resp["e"].([]interface{})
+	if len(e) == 2 {
+		code, ok1 := e[0].(int64)
+		msg, ok2 := e[1].(string)
+		if ok1 && ok2 {
+			return &KRPCError{Code: int(code), Message: msg}
+		}
+	}
+	return &KRPCError{Message: fmt.Sprintf("malformed error response: %v", resp["e"])}
+}
+
+// query 发送一次krpc查询并等待响应, 超时后重发, 返回响应中的r字典
+func (d *DHT) query(node string, q string, a map[string]interface{}) (map[string]interface{}, error) {
+	if d.Conn == nil {
+		return nil, ErrNotStarted
+	}
+	if d.closed() {
+		return nil, ErrClosed
+	}
+	addr, err := net.ResolveUDPAddr("udp", node)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ch := d.trans.add(addr)
+	defer d.trans.remove(t)
+
+	a["id"] = d.Id
+	query := map[string]interface{}{"t": t, "y": "q", "q": q, "a": a}
+	if d.readOnly {
+		query["ro"] = 1
+	}
+	msg := bencode.Encode(query)
+
+	for attempt := 0; attempt <= d.retransmits; attempt++ {
+		d.wait()
+		_, err = d.Conn.WriteToUDP(msg, addr)
+		if err != nil {
+			return nil, err
+		}
+		d.sent.add(q)
+		sentAt := d.clock.Now()
+
+		select {
+		case resp := <-ch:
+			if y, _ := resp["y"].(string); y == "e" {
+				return nil, errorResponse(resp)
+			}
+			r, ok := resp["r"].(map[string]interface{})
+			if !ok {
+				return nil, errors.New("response has no r")
+			}
+			d.seen(r, addr, d.clock.Now().Sub(sentAt))
+			return r, nil
+		case <-d.clock.After(d.queryTimeout):
+		case <-d.done:
+			return nil, ErrClosed
+		}
+	}
+	//查询都会记录超时, 不只是路由表维护时的ping
+	d.table.Failed(addr)
+	return nil, fmt.Errorf("%s %s: %w", q, node, ErrQueryTimeout)
+}
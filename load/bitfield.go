@@ -0,0 +1,109 @@
+package load
+
+import (
+	"DHTsimple/common"
+	"DHTsimple/config"
+	"errors"
+)
+
+const (
+	msgInterested = 2
+	msgHave       = 4
+	msgBitfield   = 5
+	//BEP 6
+	msgHaveAll  = 0x0e
+	msgHaveNone = 0x0f
+
+	//等待bitfield时最多读取的消息数
+	maxBitfieldMessages = 32
+)
+
+// observe 记录对方宣告拥有的piece, 不是bitfield相关的消息时返回false
+func (m *Meta) observe(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	switch data[0] {
+	case msgBitfield:
+		m.bitfield = append([]byte(nil), data[1:]...)
+	case msgHave:
+		if len(data) != 5 {
+			return false
+		}
+		index := int(data[1])<<24 | int(data[2])<<16 | int(data[3])<<8 | int(data[4])
+		if m.haves == nil {
+			m.haves = make(map[int]bool)
+		}
+		m.haves[index] = true
+		return false
+	case msgHaveAll:
+		m.haveAll = true
+	case msgHaveNone:
+		m.haveNone = true
+	default:
+		return false
+	}
+	m.seenBitfield = true
+	return true
+}
+
+// HasData WithHasDataCheck时, Begin成功后对方是否宣告拥有全部数据
+func (m *Meta) HasData() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.hasData
+}
+
+// checkHasData 下载metadata时没有收到bitfield则发送interested并等待, 再按info中的piece数判断对方是否是做种者
+func (m *Meta) checkHasData(metadata []byte) error {
+	info, err := common.DecodeDict(metadata)
+	if err != nil {
+		return err
+	}
+	hashes, _ := info["pieces"].(string)
+	if len(hashes) == 0 || len(hashes)%20 != 0 {
+		return errors.New("invalid pieces in info")
+	}
+	count := len(hashes) / 20
+
+	if err := m.WriteTo([]byte{msgInterested}); err != nil {
+		return err
+	}
+	m.SetDeadLine(config.Conf.ReadTimeout, config.Conf.WriteTimeout)
+	for i := 0; i < maxBitfieldMessages; i++ {
+		m.lock.Lock()
+		seen := m.seenBitfield
+		m.lock.Unlock()
+		if seen {
+			break
+		}
+		data, err := m.ReadN()
+		if err != nil {
+			return err
+		}
+		m.observe(data)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.hasData = m.fullBitfield(count)
+	return nil
+}
+
+// fullBitfield 调用时需持有锁
+func (m *Meta) fullBitfield(count int) bool {
+	if m.haveAll {
+		return true
+	}
+	if m.haveNone || len(m.bitfield) != (count+7)/8 {
+		return len(m.haves) == count
+	}
+	for i := 0; i < count; i++ {
+		if m.bitfield[i/8]&(0x80>>uint(i%8)) == 0 && !m.haves[i] {
+			return false
+		}
+	}
+	return true
+}
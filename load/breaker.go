@@ -0,0 +1,99 @@
+package load
+
+import (
+	"DHTsimple/common"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+type breakerState struct {
+	failures int
+	first    time.Time
+	openedAt time.Time
+	trying   bool
+}
+
+// Breaker 按peer ip统计连续失败次数, window内失败threshold次后熔断,
+// cooldown后放行一次试探连接(半开), 试探成功则恢复, 失败则重新熔断
+type Breaker struct {
+	lock      sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	clock     common.Clock
+	peers     map[string]*breakerState
+}
+
+func NewBreaker(threshold int, window time.Duration, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		clock:     common.RealClock,
+		peers:     make(map[string]*breakerState),
+	}
+}
+
+func (b *Breaker) SetClock(c common.Clock) {
+	b.lock.Lock()
+	b.clock = c
+	b.lock.Unlock()
+}
+
+func (b *Breaker) Allow(ip string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s, ok := b.peers[ip]
+	if !ok || s.openedAt.IsZero() {
+		return true
+	}
+	if s.trying || b.clock.Now().Sub(s.openedAt) < b.cooldown {
+		return false
+	}
+	s.trying = true
+	return true
+}
+
+func (b *Breaker) Success(ip string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.peers, ip)
+}
+
+// Release 结束试探但不计成功或失败, 例如ctx取消或对方不支持ut_metadata,
+// 释放半开状态下的试探名额, 下次Allow可以再次试探
+func (b *Breaker) Release(ip string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if s, ok := b.peers[ip]; ok {
+		s.trying = false
+	}
+}
+
+func (b *Breaker) Failure(ip string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := b.clock.Now()
+	s, ok := b.peers[ip]
+	if !ok || (s.openedAt.IsZero() && now.Sub(s.first) > b.window) {
+		s = &breakerState{first: now}
+		b.peers[ip] = s
+	}
+	s.failures++
+	if s.trying || s.failures >= b.threshold {
+		s.openedAt = now
+		s.trying = false
+	}
+}
+
+func peerIp(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,51 @@
+package load
+
+import (
+	"bufio"
+	"net"
+)
+
+// ConnState 下载metadata后仍然可用的连接以及协商结果
+type ConnState struct {
+	Conn         net.Conn
+	Extensions   map[string]int64
+	UtMetadata   int64
+	MetadataSize int64
+}
+
+// bufferedConn 先读完bufio中已缓存的数据, 避免交出连接时丢失
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// TakeConn 交出连接的所有权, 之后Close不再关闭该连接, 需要WithKeepOpen
+// 返回前keep-alive已经停止, 调用者拿到连接后Meta不会再写入
+func (m *Meta) TakeConn() *ConnState {
+	if !m.keepOpen || m.conn == nil {
+		return nil
+	}
+	m.stopKeepAlive()
+	m.stopWatch()
+
+	//WriteTo在writeLock下读取m.conn
+	m.writeLock.Lock()
+	conn := m.conn
+	m.conn = nil
+	m.writeLock.Unlock()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	state := &ConnState{
+		Conn:         &bufferedConn{Conn: conn, reader: m.reader},
+		Extensions:   m.extensions,
+		UtMetadata:   m.utMetadata,
+		MetadataSize: m.metadataSize,
+	}
+	m.reader = nil
+	return state
+}
@@ -0,0 +1,62 @@
+package load
+
+import (
+	"DHTsimple/common"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrRecentlyFailed = errors.New("peer recently failed")
+
+// DeadPeerCache 记录最近连接或握手失败的peer地址, ttl内不再连接
+type DeadPeerCache struct {
+	lock  sync.Mutex
+	ttl   time.Duration
+	clock common.Clock
+	peers map[string]time.Time
+}
+
+func NewDeadPeerCache(ttl time.Duration) *DeadPeerCache {
+	return &DeadPeerCache{
+		ttl:   ttl,
+		clock: common.RealClock,
+		peers: make(map[string]time.Time),
+	}
+}
+
+func (c *DeadPeerCache) SetClock(clock common.Clock) {
+	c.lock.Lock()
+	c.clock = clock
+	c.lock.Unlock()
+}
+
+func (c *DeadPeerCache) Add(addr string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.clock.Now()
+	c.peers[addr] = now.Add(c.ttl)
+
+	//数量较多时顺带清理过期条目
+	if len(c.peers) > 4096 && len(c.peers)%1024 == 0 {
+		for a, expires := range c.peers {
+			if now.After(expires) {
+				delete(c.peers, a)
+			}
+		}
+	}
+}
+
+func (c *DeadPeerCache) Failed(addr string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expires, ok := c.peers[addr]
+	if !ok {
+		return false
+	}
+	if c.clock.Now().After(expires) {
+		delete(c.peers, addr)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package load
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNoUtMetadata 对方不支持ut_metadata扩展, 重试没有意义
+	ErrNoUtMetadata = errors.New("peer does not support ut_metadata")
+	// ErrNoMetadataSize 对方支持ut_metadata但没有给出metadata_size
+	ErrNoMetadataSize = errors.New("peer did not advertise metadata_size")
+)
+
+var ErrInfoHashMismatch = errors.New("info hash mismatch")
+
+var (
+	// ErrMetadataSizeMismatch 对方给出的metadata_size与WithExpectedMetadataSize指定的不同
+	ErrMetadataSizeMismatch = errors.New("metadata_size mismatch")
+	// ErrChecksumMismatch 下载的metadata的sha1与infohash不同
+	ErrChecksumMismatch = errors.New("metadata checksum mismatch")
+	// ErrTooManyPieces metadata_size对应的piece数超过WithMaxPieces
+	ErrTooManyPieces = errors.New("too many metadata pieces")
+)
+
+// InfoHashMismatchError 对方握手中的infohash与请求的不同, errors.Is(err, ErrInfoHashMismatch)为true
+type InfoHashMismatchError struct {
+	Got  []byte
+	Want []byte
+}
+
+func (e *InfoHashMismatchError) Error() string {
+	return fmt.Sprintf("info hash mismatch: got %x, want %x", e.Got, e.Want)
+}
+
+func (e *InfoHashMismatchError) Is(target error) bool {
+	return target == ErrInfoHashMismatch
+}
+
+// ChecksumMismatchError metadata的sha1与infohash不同, errors.Is(err, ErrChecksumMismatch)为true
+// Len与WantLen不同说明是分片或拼接的问题, 相同则是对方的数据本身不对
+type ChecksumMismatchError struct {
+	Got     []byte
+	Want    []byte
+	Len     int64
+	WantLen int64
+	//每个piece收到的字节数, 边读边写出时为空
+	PieceLens []int
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("metadata checksum mismatch: got %x, want %x, len %d, metadata_size %d, piece lens %v",
+		e.Got, e.Want, e.Len, e.WantLen, e.PieceLens)
+}
+
+func (e *ChecksumMismatchError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
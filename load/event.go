@@ -0,0 +1,108 @@
+package load
+
+import (
+	"errors"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventDialed EventType = iota
+	EventHandshaked
+	EventExtHandshaked
+	EventPieceReceived
+	EventCompleted
+	EventFailed
+)
+
+var eventNames = [...]string{"dialed", "handshaked", "ext_handshaked", "piece_received", "completed", "failed"}
+
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventNames) {
+		return "unknown"
+	}
+	return eventNames[t]
+}
+
+// Phase 下载失败时所处的阶段
+type Phase string
+
+const (
+	PhaseUnknown      Phase = ""
+	PhaseDial         Phase = "dial"
+	PhaseHandshake    Phase = "handshake"
+	PhaseExtHandshake Phase = "ext_handshake"
+	PhaseFetch        Phase = "fetch"
+	//metadata已下载完但sha1不匹配
+	PhaseVerify Phase = "verify"
+)
+
+// PhaseError Connect和Begin返回的错误都带有失败的阶段, errors.Is/As可以继续匹配Err
+type PhaseError struct {
+	Phase Phase
+	Err   error
+}
+
+func (e *PhaseError) Error() string {
+	return string(e.Phase) + ": " + e.Err.Error()
+}
+
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorPhase 返回err所处的阶段, 不是Connect/Begin返回的错误时为PhaseUnknown, 用于按阶段统计失败
+func ErrorPhase(err error) Phase {
+	var pe *PhaseError
+	if errors.As(err, &pe) {
+		return pe.Phase
+	}
+	return PhaseUnknown
+}
+
+// Event 下载过程中的状态变化, 只有与Type对应的字段有值
+type Event struct {
+	Type     EventType
+	Addr     string
+	InfoHash []byte
+
+	//EventExtHandshaked
+	MetadataSize int64
+	Pieces       int64
+	//EventPieceReceived
+	Piece int
+	//EventCompleted
+	Duration time.Duration
+	//EventFailed
+	Err   error
+	Phase Phase
+}
+
+// emit 非阻塞发送, 通道满时丢弃事件, 不影响下载
+// 设置了logEvent(如WithSlog)时同步调用
+func (m *Meta) emit(ev Event) {
+	if m.events == nil && m.logEvent == nil {
+		return
+	}
+	ev.Addr = m.addr
+	ev.InfoHash = m.infoHash
+	if m.logEvent != nil {
+		m.logEvent(ev)
+	}
+	if m.events == nil {
+		return
+	}
+	select {
+	case m.events <- ev:
+	default:
+	}
+}
+
+func (m *Meta) fail(phase Phase, err error) error {
+	if phase == PhaseFetch && errors.Is(err, ErrChecksumMismatch) {
+		phase = PhaseVerify
+	}
+	m.emit(Event{Type: EventFailed, Err: err, Phase: phase})
+	return &PhaseError{Phase: phase, Err: err}
+}
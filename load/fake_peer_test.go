@@ -0,0 +1,201 @@
+package load
+
+import (
+	"DHTsimple/common"
+	"DHTsimple/config"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marksamman/bencode"
+)
+
+func TestMain(m *testing.M) {
+	//测试目录下没有config.yaml, 使用较短的超时
+	config.Conf.ConnectTimeout = 3
+	config.Conf.HandTimeout = 3
+	config.Conf.ReadTimeout = 3
+	config.Conf.WriteTimeout = 3
+	os.Exit(m.Run())
+}
+
+// fakePeer 提供metadata的模拟peer, 用于在本地完成完整的握手和下载
+type fakePeer struct {
+	metadata []byte
+	//扩展握手中声明的ut_metadata id, 0时使用1
+	utMetadata int64
+	//扩展握手中声明的metadata_size, 0时为metadata的长度
+	size int
+	//扩展握手之前发送的消息, 如bitfield
+	before [][]byte
+	//追加在扩展握手字典之后的字节
+	trailer []byte
+	//发送扩展握手前的等待时间, 期间对方关闭连接时serve立即返回
+	stall time.Duration
+	//每个piece发送前的等待时间
+	delay time.Duration
+	//收到请求后用这个函数生成回复, 为nil时回复正确的piece
+	reply func(piece int64) []byte
+
+	listener net.Listener
+	//每个连接结束时写入, 读取端可以知道对方是否提前关闭了连接
+	closed chan error
+	//收到的请求消息, 不含长度前缀
+	requests chan []byte
+}
+
+func startFakePeer(t *testing.T, p *fakePeer) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.listener = l
+	p.closed = make(chan error, 16)
+	p.requests = make(chan []byte, 1024)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				p.closed <- p.serve(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (p *fakePeer) serve(conn net.Conn) error {
+	hash := InfoHash(p.metadata)
+	handshake := make([]byte, 68)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return err
+	}
+	reply := append([]byte(nil), common.MakePreHeader()...)
+	reply = append(reply, hash[:]...)
+	reply = append(reply, "-FP0001-000000000000"...)
+	if _, err := conn.Write(reply); err != nil {
+		return err
+	}
+
+	if p.stall > 0 {
+		conn.SetReadDeadline(time.Now().Add(p.stall))
+		for {
+			//丢弃对方的扩展握手, 直到超时
+			if _, err := readMessage(conn); err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return err
+			}
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+
+	for _, msg := range p.before {
+		if err := writeMessage(conn, msg); err != nil {
+			return err
+		}
+	}
+	id := p.utMetadata
+	if id == 0 {
+		id = 1
+	}
+	size := p.size
+	if size == 0 {
+		size = len(p.metadata)
+	}
+	ext := bencode.Encode(map[string]interface{}{
+		"m":             map[string]interface{}{"ut_metadata": id},
+		"metadata_size": size,
+	})
+	ext = append(append([]byte{extended, extHandshake}, ext...), p.trailer...)
+	if err := writeMessage(conn, ext); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+		if len(msg) < 2 || msg[0] != extended || msg[1] == extHandshake {
+			continue
+		}
+		p.requests <- msg
+		if int64(msg[1]) != id {
+			continue
+		}
+		req, err := common.DecodeDict(msg[2:])
+		if err != nil {
+			return err
+		}
+		piece, _ := req["piece"].(int64)
+		if p.delay > 0 {
+			time.Sleep(p.delay)
+		}
+		var data []byte
+		if p.reply != nil {
+			data = p.reply(piece)
+		} else {
+			data = p.piece(piece)
+		}
+		//回复使用我们在扩展握手中声明的id
+		if err := writeMessage(conn, append([]byte{extended, ourUtMetadata}, data...)); err != nil {
+			return err
+		}
+	}
+}
+
+// piece 第index块的data消息
+func (p *fakePeer) piece(index int64) []byte {
+	start := index * perBlock
+	end := start + perBlock
+	if end > int64(len(p.metadata)) {
+		end = int64(len(p.metadata))
+	}
+	head := bencode.Encode(map[string]interface{}{
+		"msg_type":   msgData,
+		"piece":      index,
+		"total_size": len(p.metadata),
+	})
+	return append(head, p.metadata[start:end]...)
+}
+
+func writeMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(buf, uint32(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+func readMessage(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// testMetadata 长度正好为size的info字典, 用pad字段补足长度
+func testMetadata(size int) []byte {
+	head := "d6:lengthi1e4:name4:test3:pad"
+	for n := size - len(head) - 2; n > 0; n-- {
+		pad := strconv.Itoa(n) + ":" + strings.Repeat("x", n)
+		if len(head)+len(pad)+1 == size {
+			return []byte(head + pad + "e")
+		}
+	}
+	panic("metadata size too small")
+}
@@ -0,0 +1,320 @@
+package load
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrNoPeers = errors.New("no peers")
+
+type FetchResult struct {
+	Data       []byte
+	Duration   time.Duration
+	PeersTried int
+	//WithKeepOpen时为下载所用的连接, 调用者负责关闭
+	Conn *ConnState
+	//WithSkipChecksum时Data的sha1与infohash不同, 这样的数据不会写入MetaStore
+	ChecksumMismatch bool
+	//所有尝试过的peer的连接上读写的字节数, 包括握手和失败的下载
+	BytesRead    int64
+	BytesWritten int64
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  *FetchResult
+	err  error
+}
+
+// flightGroup 同一个key同时只执行一次fn, 并发的调用者共享结果
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Do 等待中的调用者在自己的ctx结束时返回; 执行fn的调用者因为它的ctx结束而失败时,
+// 等待者不接受这个错误, 由其中一个用自己的fn重新执行.
+// 连接只属于执行fn的调用者, 等待者得到的FetchResult中Conn为nil
+func (g *flightGroup) Do(ctx context.Context, key string, fn func() (*FetchResult, error)) (*FetchResult, error) {
+	for {
+		g.lock.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*flightCall)
+		}
+		c, ok := g.calls[key]
+		if !ok {
+			break
+		}
+		g.lock.Unlock()
+
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if errors.Is(c.err, context.Canceled) || errors.Is(c.err, context.DeadlineExceeded) {
+			continue
+		}
+		if c.val == nil {
+			return nil, c.err
+		}
+		ret := *c.val
+		ret.Conn = nil
+		return &ret, c.err
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	c.val, c.err = fn()
+
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+	close(c.done)
+	return c.val, c.err
+}
+
+var fetchGroup flightGroup
+
+// InFlightFetches 正在进行的FetchMetadata数, 同一infohash的并发调用只算一次
+func InFlightFetches() int {
+	fetchGroup.lock.Lock()
+	defer fetchGroup.lock.Unlock()
+	return len(fetchGroup.calls)
+}
+
+// FetchMetadata 依次尝试peers下载hash对应的metadata, 直到成功
+// 同一个hash的并发调用只会下载一次, 结果写入MetaStore, WithKeepOpen时只有实际下载的调用者得到Conn
+func FetchMetadata(ctx context.Context, hash []byte, peers []string, opts ...Option) (*FetchResult, error) {
+	return RaceMetadata(ctx, hash, peers, 1, opts...)
+}
+
+// RaceMetadata 同时从最多parallel个peer下载, 第一个成功后取消其余的下载并关闭它们的连接
+func RaceMetadata(ctx context.Context, hash []byte, peers []string, parallel int, opts ...Option) (*FetchResult, error) {
+	return RaceMetadataByFamily(ctx, hash, peers, parallel, NoPreference, opts...)
+}
+
+// RaceMetadataByFamily 与RaceMetadata相同, 但先尝试pref地址族的peer, 另一个地址族的peer排在后面但仍会尝试
+func RaceMetadataByFamily(ctx context.Context, hash []byte, peers []string, parallel int, pref AddressFamily, opts ...Option) (*FetchResult, error) {
+	if pref < NoPreference || pref > PreferIPv6 {
+		return nil, fmt.Errorf("invalid address family preference %d", pref)
+	}
+	peers = orderByFamily(peers, pref)
+	return raceMetadata(ctx, hash, func(ctx context.Context) (<-chan string, error) {
+		ch := make(chan string, len(peers))
+		for _, p := range peers {
+			ch <- p
+		}
+		close(ch)
+		return ch, nil
+	}, parallel, opts)
+}
+
+// FetchFromSource 与RaceMetadata相同, 但边从src取peer边下载, 直到某个peer给出metadata或src没有更多的peer
+// 重复的地址只尝试一次, 不按地址族排序
+func FetchFromSource(ctx context.Context, hash []byte, src PeerSource, parallel int, opts ...Option) (*FetchResult, error) {
+	var infoHash [20]byte
+	copy(infoHash[:], hash)
+	return raceMetadata(ctx, hash, func(ctx context.Context) (<-chan string, error) {
+		addrs, err := src.Peers(ctx, infoHash)
+		if err != nil {
+			return nil, err
+		}
+		return uniqueAddrs(ctx, addrs), nil
+	}, parallel, opts)
+}
+
+// uniqueAddrs 把addrs转换为字符串地址并去重, ctx结束或addrs关闭时关闭返回的channel
+func uniqueAddrs(ctx context.Context, addrs <-chan net.Addr) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		seen := make(map[string]bool)
+		for {
+			select {
+			case addr, ok := <-addrs:
+				if !ok {
+					return
+				}
+				s := addr.String()
+				if seen[s] {
+					continue
+				}
+				seen[s] = true
+				select {
+				case out <- s:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// peerFunc 返回本次下载的候选peer, ctx在下载结束时取消
+type peerFunc func(ctx context.Context) (<-chan string, error)
+
+func raceMetadata(ctx context.Context, hash []byte, peers peerFunc, parallel int, opts []Option) (*FetchResult, error) {
+	if data, ok := cachedMetadata(hash); ok {
+		return &FetchResult{Data: data}, nil
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+	return fetchGroup.Do(ctx, flightKey(hash, opts), func() (*FetchResult, error) {
+		if data, ok := cachedMetadata(hash); ok {
+			return &FetchResult{Data: data}, nil
+		}
+		ret, err := fetchPeers(ctx, hash, peers, parallel, opts)
+		if err != nil {
+			return nil, err
+		}
+		if !VerifyInfoHash(ret.Data, hash) {
+			ret.ChecksumMismatch = true
+			return ret, nil
+		}
+		MetaStore.Put(hash, ret.Data)
+		FetchDuration.Observe(ret.Duration.Seconds())
+		FetchPeersTried.Observe(float64(ret.PeersTried))
+		return ret, nil
+	})
+}
+
+// flightKey WithSkipChecksum的下载单独合并, 没有指定的调用者不会得到sha1不匹配的数据
+func flightKey(hash []byte, opts []Option) string {
+	m := &Meta{}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.skipChecksum {
+		return string(hash) + "/skip-checksum"
+	}
+	return string(hash)
+}
+
+func fetchPeers(parent context.Context, hash []byte, candidates peerFunc, parallel int, opts []Option) (*FetchResult, error) {
+	start := time.Now()
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	opts = append([]Option{WithContext(ctx)}, opts...)
+	peers, err := candidates(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock sync.Mutex
+	var ret *FetchResult
+	err = ErrNoPeers
+	next := 0
+	//失败的peer给出的metadata_size, 只用来提示大小不一致, 不用来拒绝其它peer:
+	//只有sha1校验通过的数据才能确定大小, 而校验通过时下载已经结束
+	sizes := make(map[int64]int)
+	var bytesRead, bytesWritten int64
+
+	worker := func() {
+		for {
+			var addr string
+			select {
+			case p, ok := <-peers:
+				if !ok {
+					return
+				}
+				addr = p
+			case <-ctx.Done():
+				return
+			}
+
+			lock.Lock()
+			if ret != nil || ctx.Err() != nil {
+				lock.Unlock()
+				return
+			}
+			next++
+			tried := next
+			lock.Unlock()
+
+			data, conn, advertised, read, written, fetchErr := fetchFrom(addr, hash, opts)
+
+			lock.Lock()
+			bytesRead += read
+			bytesWritten += written
+			switch {
+			case fetchErr == nil && ret == nil:
+				ret = &FetchResult{Data: data, Duration: time.Since(start), PeersTried: tried, Conn: conn}
+				cancel()
+			case fetchErr == nil:
+				//同时完成的其它peer
+				if conn != nil {
+					conn.Conn.Close()
+				}
+			case ret != nil:
+			default:
+				if advertised > 0 {
+					if len(sizes) > 0 && sizes[advertised] == 0 {
+						fmt.Printf("peer %s metadata_size %d of %x differs from other peers\n", addr, advertised, hash)
+					}
+					sizes[advertised]++
+				}
+				err = fetchErr
+			}
+			lock.Unlock()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker()
+		}()
+	}
+	wg.Wait()
+
+	if ret != nil {
+		ret.BytesRead, ret.BytesWritten = bytesRead, bytesWritten
+		return ret, nil
+	}
+	if parent.Err() != nil {
+		return nil, parent.Err()
+	}
+	return nil, fmt.Errorf("fetch %x failed: %w", hash, err)
+}
+
+// cachedMetadata 从MetaStore取metadata, 校验不通过视为未命中, 重新下载后覆盖
+func cachedMetadata(hash []byte) ([]byte, bool) {
+	data, ok := MetaStore.Get(hash)
+	if !ok {
+		return nil, false
+	}
+	if !VerifyInfoHash(data, hash) {
+		fmt.Printf("cached metadata of %x corrupted\n", hash)
+		return nil, false
+	}
+	return data, true
+}
+
+// fetchFrom 返回的size为对方给出的metadata_size, 扩展握手未完成时为0, read和written为连接上读写的字节数
+func fetchFrom(addr string, hash []byte, opts []Option) (data []byte, conn *ConnState, size, read, written int64, err error) {
+	m := NewMeta(addr, hash, opts...)
+	defer m.Close()
+	defer func() {
+		read, written = m.BytesRead(), m.BytesWritten()
+	}()
+	if err = m.Connect(); err != nil {
+		return nil, nil, 0, 0, 0, err
+	}
+	data, err = m.Begin()
+	if err != nil {
+		return nil, nil, m.metadataSize, 0, 0, err
+	}
+	return data, m.TakeConn(), m.metadataSize, 0, 0, nil
+}
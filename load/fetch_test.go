@@ -0,0 +1,249 @@
+package load
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// isolateMetaStore 测试期间使用空的MetaStore, 不使用之前缓存的结果
+func isolateMetaStore(t *testing.T) {
+	store := MetaStore
+	MetaStore = NewMemoryStore(0)
+	t.Cleanup(func() { MetaStore = store })
+}
+
+// 最后一块短于perBlock, 每次用不同的大小, 避免命中MetaStore
+func TestFetchPartialLastPiece(t *testing.T) {
+	for _, size := range []int{2*perBlock + 1234, perBlock + 1, 100} {
+		metadata := testMetadata(size)
+		addr := startFakePeer(t, &fakePeer{metadata: metadata})
+		hash := InfoHash(metadata)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ret, err := FetchMetadata(ctx, hash[:], []string{addr})
+		cancel()
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(ret.Data, metadata) || ret.ChecksumMismatch {
+			t.Fatalf("size %d: fetched metadata differs", size)
+		}
+	}
+}
+
+func TestFetchRejectsWrongLastPieceLength(t *testing.T) {
+	metadata := testMetadata(perBlock + 500)
+	p := &fakePeer{metadata: metadata}
+	p.reply = func(i int64) []byte {
+		data := p.piece(i)
+		if i == 1 {
+			//最后一块少一个字节
+			data = data[:len(data)-1]
+		}
+		return data
+	}
+	addr := startFakePeer(t, p)
+	hash := InfoHash(metadata)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := FetchMetadata(ctx, hash[:], []string{addr})
+	if err == nil || !strings.Contains(err.Error(), "piece 1 length") {
+		t.Fatalf("fetch err %v, want a last piece length error", err)
+	}
+}
+
+// 两个peer同时下载, 快的完成后慢的连接立即被关闭, 也不记为失败的peer
+func TestRaceClosesSlowerPeer(t *testing.T) {
+	isolateMetaStore(t)
+	metadata := testMetadata(3*perBlock + 10)
+	hash := InfoHash(metadata)
+	slow := &fakePeer{metadata: metadata, stall: 10 * time.Second}
+	fast := &fakePeer{metadata: metadata, delay: 20 * time.Millisecond}
+	slowAddr := startFakePeer(t, slow)
+	fastAddr := startFakePeer(t, fast)
+
+	dead := NewDeadPeerCache(time.Minute)
+	breaker := NewBreaker(1, time.Minute, time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ret, err := RaceMetadata(ctx, hash[:], []string{slowAddr, fastAddr}, 2, WithDeadPeerCache(dead), WithBreaker(breaker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ret.Data, metadata) {
+		t.Fatal("fetched metadata differs")
+	}
+
+	select {
+	case <-slow.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("slower peer's connection still open")
+	}
+	if dead.Failed(slowAddr) {
+		t.Fatal("cancelled peer recorded as dead")
+	}
+	if !breaker.Allow(peerIp(slowAddr)) {
+		t.Fatal("cancelled peer tripped the breaker")
+	}
+}
+
+// 半开状态下的试探连接因ctx取消结束, 不计成功或失败, 但要释放试探名额
+func TestBreakerReleasesProbeOnCancel(t *testing.T) {
+	isolateMetaStore(t)
+	metadata := testMetadata(perBlock + 10)
+	hash := InfoHash(metadata)
+	addr := startFakePeer(t, &fakePeer{metadata: metadata, stall: 10 * time.Second})
+	ip := peerIp(addr)
+
+	breaker := NewBreaker(1, time.Minute, 10*time.Millisecond)
+	breaker.Failure(ip)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := RaceMetadata(ctx, hash[:], []string{addr}, 1, WithBreaker(breaker)); err == nil {
+		t.Fatal("fetch from a stalled peer succeeded")
+	}
+	if !breaker.Allow(ip) {
+		t.Fatal("cancelled probe left the breaker half-open")
+	}
+}
+
+// WithSkipChecksum的下载不与普通下载合并, 普通调用者仍然得到ErrChecksumMismatch
+func TestSkipChecksumNotSharedWithWaiters(t *testing.T) {
+	isolateMetaStore(t)
+	metadata := testMetadata(perBlock + 10)
+	hash := InfoHash(metadata)
+	p := &fakePeer{metadata: metadata, delay: 200 * time.Millisecond}
+	p.reply = func(i int64) []byte {
+		data := p.piece(i)
+		//长度不变, sha1不同
+		data[len(data)-1] ^= 0xff
+		return data
+	}
+	addr := startFakePeer(t, p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	leader := make(chan error, 1)
+	go func() {
+		ret, err := FetchMetadata(ctx, hash[:], []string{addr}, WithSkipChecksum())
+		if err == nil && !ret.ChecksumMismatch {
+			err = errors.New("corrupted metadata not reported")
+		}
+		leader <- err
+	}()
+	for InFlightFetches() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := FetchMetadata(ctx, hash[:], []string{addr}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("fetch err %v, want ErrChecksumMismatch", err)
+	}
+	if err := <-leader; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 我们声明ut_metadata为1, 对方声明为3: 请求使用对方的id, 对方的回复使用我们的id
+func TestFetchAsymmetricUtMetadata(t *testing.T) {
+	isolateMetaStore(t)
+	metadata := testMetadata(2*perBlock + 7)
+	p := &fakePeer{metadata: metadata, utMetadata: 3}
+	addr := startFakePeer(t, p)
+	hash := InfoHash(metadata)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ret, err := FetchMetadata(ctx, hash[:], []string{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ret.Data, metadata) {
+		t.Fatal("fetched metadata differs")
+	}
+	if len(p.requests) == 0 {
+		t.Fatal("peer got no requests")
+	}
+	for len(p.requests) > 0 {
+		if msg := <-p.requests; msg[1] != 3 {
+			t.Fatalf("request sent with ut_metadata %d, want the peer's 3", msg[1])
+		}
+	}
+}
+
+// 扩展握手字典后面带着多余的字节, 之前还有bitfield和have消息
+func TestFetchExtHandshakeTrailingBytes(t *testing.T) {
+	isolateMetaStore(t)
+	metadata := testMetadata(perBlock + 33)
+	p := &fakePeer{
+		metadata: metadata,
+		before:   [][]byte{{msgBitfield, 0xff}, {msgHave, 0, 0, 0, 1}},
+		trailer:  []byte("\x00\x00junk e d"),
+	}
+	addr := startFakePeer(t, p)
+	hash := InfoHash(metadata)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ret, err := FetchMetadata(ctx, hash[:], []string{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ret.Data, metadata) {
+		t.Fatal("fetched metadata differs")
+	}
+}
+
+func TestOrderByFamily(t *testing.T) {
+	peers := []string{"[2001:db8::1]:1", "10.0.0.1:1", "example.com:1", "[2001:db8::2]:1", "10.0.0.2:1"}
+	tests := []struct {
+		pref AddressFamily
+		want string
+	}{
+		{NoPreference, "[2001:db8::1]:1 10.0.0.1:1 example.com:1 [2001:db8::2]:1 10.0.0.2:1"},
+		{PreferIPv4, "10.0.0.1:1 10.0.0.2:1 example.com:1 [2001:db8::1]:1 [2001:db8::2]:1"},
+		{PreferIPv6, "[2001:db8::1]:1 [2001:db8::2]:1 example.com:1 10.0.0.1:1 10.0.0.2:1"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(orderByFamily(peers, tt.pref), " "); got != tt.want {
+			t.Errorf("pref %d: %s, want %s", tt.pref, got, tt.want)
+		}
+	}
+
+	hash := make([]byte, 20)
+	if _, err := RaceMetadataByFamily(context.Background(), hash, peers, 1, PreferIPv6+1); err == nil {
+		t.Fatal("accepted an invalid address family preference")
+	}
+}
+
+// 先连接的peer谎报metadata_size然后不再响应, 不能因此拒绝之后诚实的peer
+func TestFetchIgnoresSizeFromFailedPeer(t *testing.T) {
+	isolateMetaStore(t)
+	metadata := testMetadata(2*perBlock + 7)
+	hash := InfoHash(metadata)
+	stalled := make(chan struct{})
+	t.Cleanup(func() { close(stalled) })
+	liar := &fakePeer{metadata: metadata, size: 3*perBlock + 7, reply: func(int64) []byte {
+		<-stalled
+		return nil
+	}}
+	liarAddr := startFakePeer(t, liar)
+	honestAddr := startFakePeer(t, &fakePeer{metadata: metadata})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	//parallel为1, 谎报的peer超时之后才尝试诚实的peer
+	ret, err := FetchMetadata(ctx, hash[:], []string{liarAddr, honestAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ret.Data, metadata) || ret.PeersTried != 2 {
+		t.Fatalf("fetched %d bytes after %d peers", len(ret.Data), ret.PeersTried)
+	}
+}
@@ -0,0 +1,62 @@
+//go:build go1.18
+
+package load
+
+import (
+	"testing"
+
+	"github.com/marksamman/bencode"
+)
+
+// go test -run XXX -fuzz FuzzReadOnePiece ./load/
+func FuzzReadOnePiece(f *testing.F) {
+	metadata := testMetadata(2*perBlock + 100)
+	p := &fakePeer{metadata: metadata}
+	f.Add(p.piece(0))
+	f.Add(p.piece(2))
+	f.Add([]byte("d8:msg_typei0e5:piecei1ee"))
+	f.Add([]byte("d8:msg_typei1e5:piecei2e10:total_sizei1eeabc"))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		m := &Meta{metadataSize: int64(len(metadata)), pieceCount: 3, pieces: make([][]byte, 3)}
+		i, err := m.readOnePiece(payload)
+		if err != nil {
+			for j, b := range m.pieces {
+				if b != nil {
+					t.Fatalf("piece %d stored although readOnePiece failed: %v", j, err)
+				}
+			}
+			return
+		}
+		if int64(len(m.pieces[i])) != m.pieceLen(int64(i)) {
+			t.Fatalf("piece %d stored with length %d, want %d", i, len(m.pieces[i]), m.pieceLen(int64(i)))
+		}
+	})
+}
+
+// go test -run XXX -fuzz FuzzOnExtHandshake ./load/
+func FuzzOnExtHandshake(f *testing.F) {
+	f.Add(bencode.Encode(map[string]interface{}{
+		"m":             map[string]interface{}{"ut_metadata": 1, "ut_pex": 2},
+		"metadata_size": 40000,
+		"v":             "qBittorrent/4.6.0",
+		"yourip":        "\x7f\x00\x00\x01",
+		"ipv4":          "\x0a\x00\x00\x01",
+		"reqq":          250,
+	}))
+	f.Add([]byte("d1:md11:ut_metadatai3ee13:metadata_sizei-1ee"))
+	f.Add([]byte("d1:md11:ut_metadatai3ee13:metadata_sizei99999999999ee"))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		m := NewMeta("127.0.0.1:1", make([]byte, 20))
+		//只解析, 不发送请求
+		m.probing = true
+		if err := m.onExtHandshake(payload); err != nil {
+			return
+		}
+		if m.utMetadata <= 0 || m.metadataSize < 0 || m.metadataSize > maxMetadataSize {
+			t.Fatalf("accepted ut_metadata %d metadata_size %d", m.utMetadata, m.metadataSize)
+		}
+		if int64(len(m.pieces)) != m.pieceCount || m.pieceCount*perBlock < m.metadataSize {
+			t.Fatalf("%d pieces for metadata_size %d", m.pieceCount, m.metadataSize)
+		}
+	})
+}
@@ -3,16 +3,23 @@ package load
 import (
 	"DHTsimple/common"
 	"DHTsimple/config"
+	"bufio"
 	"bytes"
-	"crypto/sha1"
+	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/marksamman/bencode"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -20,30 +27,142 @@ const (
 	maxMetadataSize = perBlock * 1024
 	extended        = 20
 	extHandshake    = 0
+	//piece消息除数据外的头部冗余
+	msgOverhead    = 1024
+	minMessageSize = perBlock + msgOverhead
+	//WithContinueOnPieceError时piece出错的最大重试次数
+	maxPieceRetries = 3
 )
 
+// Meta 从一个peer下载一个infohash的metadata
+//
+// 并发约定:
+//   - Connect/UseConn必须先于其他方法完成, 握手得到的metadataSize、utMetadata、pieceCount之后只读
+//   - pieces、msgCount、extensions、nextRequest等下载状态由lock保护, 接收piece和请求piece可以在不同goroutine中进行
+//   - 写连接(WriteTo)由writeLock串行化, keep-alive等后台写入可以与请求并发
+//   - 读连接(ReadN、Begin、BeginTo)同一时间只能有一个goroutine
+//   - DumpState、BytesRead、BytesWritten、PeerExtensions可以随时从其他goroutine调用
 type Meta struct {
+	//atomic访问的int64放在开头保证32位平台上的对齐
+	bytesRead    int64
+	bytesWritten int64
+
+	lock         sync.Mutex
 	addr         string
 	infoHash     []byte
 	conn         net.Conn
+	reader       *bufio.Reader
 	peerId       string
+	peerIdGen    func() string
 	preHeader    []byte
 	metadataSize int64
-	utMetadata   int64
-	pieceCount   int64
-	pieces       [][]byte
+	//对方在扩展握手中声明的ut_metadata id, 只用于我们发出的请求
+	utMetadata int64
+	pieceCount int64
+	pieces     [][]byte
+	extensions map[string]int64
+	peerClient string
+	msgCount   int
+	//扩展握手中的yourip, 以及对方声明的自己的ipv4/ipv6地址
+	yourIp   net.IP
+	peerIPv4 net.IP
+	peerIPv6 net.IP
+
+	reqq          int
+	clientVersion string
+	listenPort    int
+
+	maxMessageSize int
+	readBufferSize int
+	optErr         error
+
+	maxBufferedPieces    int
+	partial              bool
+	wanted               []int
+	incomplete           bool
+	continueOnPieceError bool
+	pieceRetries         int
+	//WithSkipChecksum时sha1不匹配也返回数据
+	skipChecksum bool
+	badChecksum  bool
+	//Begin下载metadata的总时间, 0时使用配置中的read_timeout和write_timeout
+	fetchTimeout time.Duration
+	//metadata最多的piece数, 超过时扩展握手返回ErrTooManyPieces
+	maxPieces int64
+	//同时请求的piece数上限, 与对方的reqq取较小值, 0为不限制
+	maxInFlight int
+	peerReqq    int64
+	//下一个还没有请求的piece
+	nextRequest int
+
+	//作为服务端时提供给对方的metadata
+	serveData []byte
+
+	breaker   *Breaker
+	resolver  *Resolver
+	deadPeers *DeadPeerCache
+
+	writeLock sync.Mutex
+	lastWrite time.Time
+	keepAlive time.Duration
+	keepOpen  bool
+	//关闭stop通知keepAliveLoop退出, 退出后关闭keepAliveDone
+	stop          chan struct{}
+	keepAliveDone chan struct{}
+
+	handShakeRetry time.Duration
+	expectedSize   int64
+	//Probe时扩展握手后不请求piece
+	probing          bool
+	requestTotalSize bool
+
+	events   chan<- Event
+	logEvent func(Event)
+	start    time.Time
+	clock    common.Clock
+
+	ctx      context.Context
+	limiters []*rate.Limiter
+	//每次拨号前取得一个令牌
+	dialLimiter *rate.Limiter
+	//关闭后停止watchContext
+	unwatch chan struct{}
+
+	//对方宣告拥有的piece, 见bitfield.go
+	checkData    bool
+	seenBitfield bool
+	bitfield     []byte
+	haves        map[int]bool
+	haveAll      bool
+	haveNone     bool
+	hasData      bool
 }
 
-func NewMeta(addr string, hash []byte) *Meta {
-	return &Meta{
-		addr:      addr,
-		infoHash:  hash,
-		peerId:    common.RandString(20),
-		preHeader: common.MakePreHeader(),
+func NewMeta(addr string, hash []byte, opts ...Option) *Meta {
+	fp := currentFingerprint()
+	m := &Meta{
+		addr:          addr,
+		infoHash:      hash,
+		peerIdGen:     fp.peerIDGenerator(),
+		clientVersion: fp.Version,
+		preHeader:     common.MakePreHeader(),
+
+		readBufferSize: 4096,
+		maxPieces:      maxMetadataSize / perBlock,
+		resolver:       DefaultResolver,
+		ctx:            context.Background(),
+		clock:          common.RealClock,
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.peerId = m.peerIdGen()
+	return m
 }
 
 func (mw *Meta) checkDone() bool {
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
 	for _, b := range mw.pieces {
 		if b == nil {
 			return false
@@ -52,88 +171,268 @@ func (mw *Meta) checkDone() bool {
 	return true
 }
 
-func (m *Meta) readOnePiece(payload []byte) error {
-	trailerIndex := bytes.Index(payload, []byte("ee")) + 2
-	if trailerIndex == 1 {
-		return errors.New("ee == 1")
+func (m *Meta) readOnePiece(payload []byte) (int, error) {
+	//字典之后是piece数据, 数据本身可能包含"ee", 只能按字典实际占用的长度切分
+	v, n, err := common.DecodeValue(bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return 0, errors.New("piece message is not a dict")
 	}
 
-	dict, err := bencode.Decode(bytes.NewBuffer(payload[:trailerIndex]))
-	if err != nil {
-		return err
+	//对方的数据不可信, 先校验所有字段再保存
+	msgType, ok := dict["msg_type"].(int64)
+	if !ok {
+		return 0, errors.New("piece has no msg_type")
+	}
+	switch msgType {
+	case msgData:
+	case msgRequest:
+		return 0, errors.New("peer sent a request instead of data")
+	case msgReject:
+		return 0, errors.New("peer rejected piece request")
+	default:
+		return 0, fmt.Errorf("piece type error: %d", msgType)
 	}
 
 	pieceIndex, ok := dict["piece"].(int64)
-	if !ok || pieceIndex >= m.pieceCount {
-		return errors.New("piece num error")
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !ok || pieceIndex < 0 || pieceIndex >= int64(len(m.pieces)) {
+		return 0, errors.New("piece num error")
+	}
+	if totalSize, ok := dict["total_size"]; ok {
+		if size, ok := totalSize.(int64); !ok || size != m.metadataSize {
+			return 0, fmt.Errorf("piece total_size %v, want %d", totalSize, m.metadataSize)
+		}
+	}
+	data := payload[n:]
+	if want := m.pieceLen(pieceIndex); int64(len(data)) != want {
+		return 0, fmt.Errorf("piece %d length %d, want %d", pieceIndex, len(data), want)
 	}
+	//重复的piece保留先收到的
+	if m.pieces[pieceIndex] == nil {
+		m.pieces[pieceIndex] = data
+	}
+	return int(pieceIndex), nil
+}
 
-	msgType, ok := dict["msg_type"].(int64)
-	if !ok || msgType != 1 {
-		return errors.New("piece type error")
+// pieceLen 除最后一块外每块都是perBlock字节, 最后一块为剩余的字节数, 调用时需持有锁
+func (m *Meta) pieceLen(index int64) int64 {
+	if index == m.pieceCount-1 {
+		return m.metadataSize - index*perBlock
 	}
-	m.pieces[pieceIndex] = payload[trailerIndex:]
-	return nil
+	return perBlock
 }
 
+// sendRequestPiece 请求窗口内的piece, 之后每收到一个piece再请求下一个
 func (m *Meta) sendRequestPiece() {
-	for i := 0; i < int(m.pieceCount); i++ {
+	window := m.window()
+	for {
+		m.lock.Lock()
+		i := m.nextRequest
+		if i >= int(m.pieceCount) || window > 0 && i >= window {
+			m.lock.Unlock()
+			return
+		}
+		m.nextRequest++
+		m.lock.Unlock()
 		m.requestPiece(i)
 	}
 }
 
+// requestNext 收到一个piece后窗口空出一个位置
+func (m *Meta) requestNext() {
+	m.lock.Lock()
+	if m.partial || m.nextRequest >= int(m.pieceCount) {
+		m.lock.Unlock()
+		return
+	}
+	i := m.nextRequest
+	m.nextRequest++
+	m.lock.Unlock()
+	m.requestPiece(i)
+}
+
+// window 同时请求的piece数, 对方的reqq和WithMaxInFlightPieces中较小的一个, 0为不限制
+func (m *Meta) window() int {
+	window := int(m.peerReqq)
+	if m.maxInFlight > 0 && (window <= 0 || m.maxInFlight < window) {
+		window = m.maxInFlight
+	}
+	return window
+}
+
+// Begin 下载metadata, 返回原始的info字典bencode字节, 不做解析, 需要Torrent时使用Start
 func (m *Meta) Begin() ([]byte, error) {
-	m.SetDeadLine(config.Conf.ReadTimeout, config.Conf.WriteTimeout)
+	ret, err := m.begin()
+	if err != nil {
+		return nil, m.fail(PhaseFetch, err)
+	}
+	if m.checkData && len(m.wanted) == 0 {
+		if err := m.checkHasData(ret); err != nil {
+			fmt.Printf("check %s has data err:%s\n", m.addr, err.Error())
+		}
+	}
+	m.emit(Event{Type: EventCompleted, Duration: m.clock.Now().Sub(m.start)})
+	return ret, nil
+}
+
+// Start 与Begin相同, 并把下载的metadata解析为Torrent
+// 需要保存原始info字典(重新计算infohash或写入.torrent文件)时使用Begin, 它返回的就是计算infohash的原始bencode字节
+func (m *Meta) Start() (*Torrent, error) {
+	raw, err := m.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return parseTorrent(raw, hex.EncodeToString(m.infoHash))
+}
+
+// ChecksumMismatch WithSkipChecksum时, Begin返回的数据的sha1是否与infohash不同
+func (m *Meta) ChecksumMismatch() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.badChecksum
+}
+
+func (m *Meta) begin() ([]byte, error) {
+	defer m.startFetch()()
 
 	for {
-		data, err := m.ReadN()
+		index, err := m.nextPiece()
 		if err != nil {
 			return nil, err
 		}
+		m.emit(Event{Type: EventPieceReceived, Piece: index})
 
-		if len(data) < 2 {
-			continue
+		if len(m.wanted) > 0 {
+			if data, ok := m.wantedDone(); ok && m.incomplete {
+				return data, nil
+			}
 		}
 
-		if data[0] != extended {
+		if !m.checkDone() {
 			continue
 		}
 
-		if data[1] != 1 {
-			continue
+		pie := bytes.Join(m.pieces, []byte(""))
+		sum := InfoHash(pie)
+		if bytes.Equal(sum[:], m.infoHash) {
+			return pie, nil
+		}
+		if m.skipChecksum {
+			fmt.Printf("warning: metadata from %s has sha1 %x, want %x\n", m.addr, sum, m.infoHash)
+			m.lock.Lock()
+			m.badChecksum = true
+			m.lock.Unlock()
+			return pie, nil
+		}
+
+		m.lock.Lock()
+		lens := make([]int, len(m.pieces))
+		for i, piece := range m.pieces {
+			lens[i] = len(piece)
+		}
+		m.lock.Unlock()
+		return nil, &ChecksumMismatchError{Got: sum[:], Want: m.infoHash, Len: int64(len(pie)), WantLen: m.metadataSize, PieceLens: lens}
+	}
+}
+
+// startFetch 设置下载超时, 返回的函数在下载结束时调用, 没有WithKeepOpen时停止keep-alive并等待其退出
+func (m *Meta) startFetch() func() {
+	if m.fetchTimeout > 0 {
+		m.conn.SetDeadline(time.Now().Add(m.fetchTimeout))
+	} else {
+		m.SetDeadLine(config.Conf.ReadTimeout, config.Conf.WriteTimeout)
+	}
+	return func() {
+		if !m.keepOpen {
+			m.stopKeepAlive()
 		}
+	}
+}
 
-		err = m.readOnePiece(data[2:])
+// nextPiece 读取消息直到收到一个metadata piece, 返回piece序号
+func (m *Meta) nextPiece() (int, error) {
+	for {
+		data, err := m.ReadN()
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 
-		if !m.checkDone() {
+		if len(data) < 2 {
 			continue
 		}
 
-		pie := bytes.Join(m.pieces, []byte(""))
-		sum := sha1.Sum(pie)
-		if bytes.Equal(sum[:], m.infoHash) {
-			return pie, nil
+		if data[0] != extended {
+			m.observe(data)
+			continue
+		}
+
+		//对方回复时使用我们声明的id, 不是它自己声明的
+		if data[1] != ourUtMetadata {
+			continue
+		}
+
+		index, err := m.readOnePiece(data[2:])
+		if err != nil && m.continueOnPieceError && m.pieceRetries < maxPieceRetries {
+			m.pieceRetries++
+			fmt.Printf("read piece err:%s, request missing pieces again\n", err.Error())
+			m.requestMissing()
+			continue
+		}
+		if err == nil {
+			m.requestNext()
 		}
+		return index, err
+	}
+}
 
-		return nil, errors.New("metadata checksum mismatch")
+func (m *Meta) requestMissing() {
+	m.lock.Lock()
+	var missing []int
+	if m.partial {
+		//只重新请求RequestPieces指定的piece
+		seen := make(map[int]bool)
+		for _, i := range m.wanted {
+			if m.pieces[i] == nil && !seen[i] {
+				seen[i] = true
+				missing = append(missing, i)
+			}
+		}
+	} else {
+		for i, b := range m.pieces {
+			//窗口之外的piece还没有请求过
+			if b == nil && i < m.nextRequest {
+				missing = append(missing, i)
+			}
+		}
+	}
+	m.lock.Unlock()
+	for _, i := range missing {
+		m.requestPiece(i)
 	}
 }
 
 func (m *Meta) Load() []byte {
 	err := m.Connect()
 	if err != nil {
+		m.Close()
 		fmt.Printf("connect err:%s\n", err.Error())
 		return nil
 	}
-	defer m.conn.Close()
 	ret, err := m.Begin()
 	if err != nil {
+		m.Close()
 		fmt.Printf("load  err:%s\n", err.Error())
 		return nil
 	}
+	//WithKeepOpen时连接由调用者通过TakeConn取得
+	if !m.keepOpen {
+		m.Close()
+	}
 	return ret
 }
 
@@ -142,19 +441,279 @@ func (m *Meta) SetDeadLine(readTimeout int, writeTimeout int) {
 	m.conn.SetWriteDeadline(time.Now().Add(time.Duration(writeTimeout) * time.Second))
 }
 
+// Connect 连接并完成握手和扩展握手, 返回的错误为*PhaseError, 可以用ErrorPhase取得失败的阶段, 选项错误除外
 func (m *Meta) Connect() error {
-	var err error
-	m.conn, err = net.DialTimeout("tcp", m.addr, time.Duration(config.Conf.ConnectTimeout)*time.Second)
+	if m.optErr != nil {
+		return m.optErr
+	}
+	if err := m.resolve(); err != nil {
+		return m.fail(PhaseDial, err)
+	}
+	if m.deadPeers != nil && m.deadPeers.Failed(m.addr) {
+		return m.fail(PhaseDial, ErrRecentlyFailed)
+	}
+	err := m.connectWithBreaker()
+	if err == ErrCircuitOpen {
+		return m.fail(PhaseDial, err)
+	}
+	if m.deadPeers != nil && m.peerFailed(err) {
+		m.deadPeers.Add(m.addr)
+	}
+	return err
+}
+
+// peerFailed err是否说明对方连不上或不可用; 我们自己取消下载, 或对方只是不支持/不匹配时不算
+func (m *Meta) peerFailed(err error) bool {
+	if err == nil || m.ctx.Err() != nil {
+		return false
+	}
+	return !errors.Is(err, ErrNoUtMetadata) && !errors.Is(err, ErrMetadataSizeMismatch) && !errors.Is(err, ErrTooManyPieces)
+}
+
+func (m *Meta) connectWithBreaker() error {
+	if m.breaker == nil {
+		return m.connect()
+	}
+
+	ip := peerIp(m.addr)
+	if !m.breaker.Allow(ip) {
+		return ErrCircuitOpen
+	}
+	err := m.connect()
+	switch {
+	case err == nil:
+		m.breaker.Success(ip)
+	case m.peerFailed(err):
+		m.breaker.Failure(ip)
+	default:
+		m.breaker.Release(ip)
+	}
+	return err
+}
+
+// resolve 把m.addr中的域名替换为ip, 后续流程只处理ip地址
+func (m *Meta) resolve() error {
+	ctx, cancel := context.WithTimeout(m.ctx, time.Duration(config.Conf.ConnectTimeout)*time.Second)
+	defer cancel()
+	addr, err := m.resolver.Resolve(ctx, m.addr)
+	if err != nil {
+		return err
+	}
+	m.addr = addr
+	return nil
+}
+
+func (m *Meta) connect() error {
+	m.start = m.clock.Now()
+	err := m.dial()
+	if err != nil {
+		return m.fail(PhaseDial, err)
+	}
+	err = m.negotiate(m.dial)
+	if err != nil {
+		return err
+	}
+	m.startKeepAlive()
+	return nil
+}
+
+func (m *Meta) dial() error {
+	dialer := &net.Dialer{Timeout: time.Duration(config.Conf.ConnectTimeout) * time.Second}
+	if m.keepAlive > 0 {
+		dialer.KeepAlive = m.keepAlive
+	}
+	if m.dialLimiter != nil {
+		if err := m.dialLimiter.Wait(m.ctx); err != nil {
+			return err
+		}
+	}
+	conn, err := dialer.DialContext(m.ctx, "tcp", m.addr)
 	//m.conn, err = net.Dial("tcp", m.addr)
 	if err != nil {
 		return err
 	}
+	m.conn = conn
+	m.watchContext(conn)
+	m.emit(Event{Type: EventDialed})
+	return nil
+}
+
+// watchContext ctx取消时关闭conn, 使阻塞中的读写立即返回
+func (m *Meta) watchContext(conn net.Conn) {
+	done := m.ctx.Done()
+	if done == nil {
+		return
+	}
+	if m.unwatch == nil {
+		m.unwatch = make(chan struct{})
+	}
+	go func(stop chan struct{}) {
+		select {
+		case <-stop:
+		case <-done:
+			//Close/TakeConn先于取消发生时不能再关闭连接
+			select {
+			case <-stop:
+			default:
+				conn.Close()
+			}
+		}
+	}(m.unwatch)
+}
+
+func (m *Meta) stopWatch() {
+	if m.unwatch != nil {
+		close(m.unwatch)
+		m.unwatch = nil
+	}
+}
+
+func (m *Meta) prepareConn() {
+	m.conn = m.throttle(m.conn)
+	m.reader = bufio.NewReaderSize(m.conn, m.readBufferSize)
 	m.SetDeadLine(config.Conf.HandTimeout, config.Conf.HandTimeout)
-	err = m.HandShake()
+}
+
+// negotiate 在m.conn上完成握手和扩展握手
+// redial不为nil且设置了WithHandShakeRetry时, 握手在读到任何数据前被关闭则重连后再试一次
+func (m *Meta) negotiate(redial func() error) error {
+	m.peerId = m.peerIdGen()
+	m.prepareConn()
+	err := m.HandShake()
+	if err != nil && redial != nil && m.handShakeRetry > 0 && m.retryableHandShake(err) {
+		m.conn.Close()
+		select {
+		case <-m.clock.After(m.handShakeRetry):
+		case <-m.ctx.Done():
+			return m.fail(PhaseHandshake, m.ctx.Err())
+		}
+		if err = redial(); err != nil {
+			return m.fail(PhaseDial, err)
+		}
+		m.prepareConn()
+		err = m.HandShake()
+	}
 	if err != nil {
-		return err
+		return m.fail(PhaseHandshake, err)
+	}
+	m.emit(Event{Type: EventHandshaked})
+	err = m.extHandShake()
+	if err != nil {
+		return m.fail(PhaseExtHandshake, err)
+	}
+	m.emit(Event{Type: EventExtHandshaked, MetadataSize: m.metadataSize, Pieces: m.pieceCount})
+	return nil
+}
+
+// Close 关闭连接并等待keep-alive退出, 返回后可以安全地Reset
+func (m *Meta) Close() error {
+	m.stopWatch()
+	m.writeLock.Lock()
+	conn := m.conn
+	m.writeLock.Unlock()
+	var err error
+	if conn != nil {
+		//先关闭连接, 阻塞在写入中的keep-alive立即返回
+		err = conn.Close()
+	}
+	m.stopKeepAlive()
+	return err
+}
+
+// Reset 清除与infohash相关的状态, 使Meta可以在Close之后用于下载新的hash, 选项和addr保持不变
+// 每个infohash都需要重新握手, Reset之后必须再次调用Connect或UseConn
+// 与hash相关的选项(WithExpectedMetadataSize, RequestPieces指定的piece)也会被清除
+func (m *Meta) Reset(hash []byte) {
+	m.Close()
+	atomic.StoreInt64(&m.bytesRead, 0)
+	atomic.StoreInt64(&m.bytesWritten, 0)
+
+	m.writeLock.Lock()
+	m.conn = nil
+	m.lastWrite = time.Time{}
+	m.writeLock.Unlock()
+
+	m.lock.Lock()
+	m.infoHash = hash
+	m.peerId = m.peerIdGen()
+	m.reader = nil
+	m.metadataSize = 0
+	m.utMetadata = 0
+	m.pieceCount = 0
+	m.pieces = nil
+	m.extensions = nil
+	m.peerClient = ""
+	m.yourIp = nil
+	m.peerIPv4 = nil
+	m.peerIPv6 = nil
+	m.msgCount = 0
+	m.peerReqq = 0
+	m.nextRequest = 0
+	m.wanted = nil
+	m.incomplete = false
+	m.badChecksum = false
+	m.pieceRetries = 0
+	m.serveData = nil
+	m.expectedSize = 0
+	m.probing = false
+	m.seenBitfield = false
+	m.bitfield = nil
+	m.haves = nil
+	m.haveAll = false
+	m.haveNone = false
+	m.hasData = false
+	m.lock.Unlock()
+	m.start = time.Time{}
+}
+
+// startKeepAlive 握手完成后按WithKeepAlive启动keepAliveLoop, 已经启动时不做任何事
+func (m *Meta) startKeepAlive() {
+	if m.keepAlive <= 0 {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.keepAliveDone = make(chan struct{})
+	go m.keepAliveLoop(m.keepAlive, m.stop, m.keepAliveDone)
+}
+
+// stopKeepAlive 通知keepAliveLoop退出并等待, 返回后不会再有keep-alive写入连接
+func (m *Meta) stopKeepAlive() {
+	m.lock.Lock()
+	stop, done := m.stop, m.keepAliveDone
+	m.stop, m.keepAliveDone = nil, nil
+	m.lock.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// keepAliveLoop 连接空闲超过interval时发送长度为0的keep-alive消息
+func (m *Meta) keepAliveLoop(interval time.Duration, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		wait := common.JitteredInterval(interval, common.DefaultJitter)
+		select {
+		case <-stop:
+			return
+		case <-m.clock.After(wait):
+			m.writeLock.Lock()
+			idle := m.clock.Now().Sub(m.lastWrite)
+			m.writeLock.Unlock()
+			if idle < wait {
+				continue
+			}
+			if err := m.WriteTo(nil); err != nil {
+				return
+			}
+		}
 	}
-	return m.extHandShake()
 }
 
 func (m *Meta) WriteTo(data []byte) error {
@@ -165,7 +724,15 @@ func (m *Meta) WriteTo(data []byte) error {
 	binary.Write(buf, binary.BigEndian, length)
 
 	sendMsg := append(buf.Bytes(), data...)
-	_, err := m.conn.Write(sendMsg)
+	m.writeLock.Lock()
+	if m.conn == nil {
+		m.writeLock.Unlock()
+		return errors.New("write message failed: connection closed")
+	}
+	n, err := m.conn.Write(sendMsg)
+	m.lastWrite = m.clock.Now()
+	m.writeLock.Unlock()
+	atomic.AddInt64(&m.bytesWritten, int64(n))
 	if err != nil {
 		return fmt.Errorf("write message failed: %v", err)
 	}
@@ -174,88 +741,201 @@ func (m *Meta) WriteTo(data []byte) error {
 
 func (m *Meta) ReadN() ([]byte, error) {
 	length := make([]byte, 4)
-	_, err := io.ReadFull(m.conn, length)
+	n, err := io.ReadFull(m.reader, length)
+	atomic.AddInt64(&m.bytesRead, int64(n))
 	if err != nil {
+		if m.ctx.Err() != nil {
+			return nil, m.ctx.Err()
+		}
 		return nil, err
 	}
 
 	size := binary.BigEndian.Uint32(length)
+	if m.maxMessageSize > 0 && int64(size) > int64(m.maxMessageSize) {
+		return nil, fmt.Errorf("message too long: %d", size)
+	}
 
-	data := make([]byte, size)
-	_, err = io.ReadFull(m.conn, data)
+	data, err := m.readBody(int(size))
+	atomic.AddInt64(&m.bytesRead, int64(len(data)))
 	if err != nil {
+		if m.ctx.Err() != nil {
+			return nil, m.ctx.Err()
+		}
 		return nil, err
 	}
+	m.lock.Lock()
+	m.msgCount++
+	m.lock.Unlock()
 
 	return data, nil
 }
 
+// readBody 读取size字节, 较长的消息随读取的数据增长缓冲区, 不按对方声明的长度一次分配
+func (m *Meta) readBody(size int) ([]byte, error) {
+	if size <= minMessageSize {
+		data := make([]byte, size)
+		n, err := io.ReadFull(m.reader, data)
+		return data[:n], err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, minMessageSize))
+	_, err := io.CopyN(buf, m.reader, int64(size))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
 func (m *Meta) extHandShake() error {
 	//etxHandShark
-	data := append([]byte{extended, extHandshake}, bencode.Encode(map[string]interface{}{
-		"m": map[string]interface{}{
-			"ut_metadata": 1,
-		},
-	})...)
+	data := append([]byte{extended, extHandshake}, bencode.Encode(m.extHandshakeDict())...)
 
 	if err := m.WriteTo(data); err != nil {
 		return err
 	}
 
-	data, err := m.ReadN()
+	//很多客户端在扩展握手之前先发送bitfield/have等消息, 记录下来并继续等待扩展握手
+	for i := 0; i < maxBitfieldMessages; i++ {
+		data, err := m.ReadN()
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if data[0] != extended {
+			m.observe(data)
+			continue
+		}
+		if len(data) < 2 {
+			return errors.New("ext handshake too short")
+		}
+		if data[1] != extHandshake {
+			continue
+		}
+		//只解码开头的字典, 之后多余的字节被忽略
+		return m.onExtHandshake(data[2:])
+	}
+	return errors.New("no ext handshake")
+}
+
+func (m *Meta) extHandshakeDict() map[string]interface{} {
+	dict := map[string]interface{}{
+		"m": map[string]interface{}{
+			"ut_metadata": ourUtMetadata,
+		},
+	}
+	if m.reqq > 0 {
+		dict["reqq"] = m.reqq
+	}
+	if m.clientVersion != "" {
+		dict["v"] = m.clientVersion
+	}
+	if m.listenPort > 0 {
+		dict["p"] = m.listenPort
+	}
+	if len(m.serveData) > 0 {
+		dict["metadata_size"] = len(m.serveData)
+	}
+	return dict
+}
+
+func (m *Meta) HandShake() error {
+	err := m.writeHandShake()
 	if err != nil {
 		return err
 	}
 
-	if data[0] != extended {
-		return errors.New("data 0 err")
+	res, err := m.readHandShake()
+	if err != nil {
+		return err
 	}
-	if data[1] != 0 {
-		return errors.New("data 1 err")
+
+	if got := m.handShakeHash(res); !bytes.Equal(got, m.infoHash) {
+		return &InfoHashMismatchError{Got: append([]byte(nil), got...), Want: m.infoHash}
 	}
-	return m.onExtHandshake(data[2:])
+	return nil
 }
 
-func (m *Meta) HandShake() error {
+func (m *Meta) writeHandShake() error {
 	buf := bytes.NewBuffer(nil)
 	buf.Write(m.preHeader)
 	buf.Write(m.infoHash)
 	buf.WriteString(m.peerId)
-	_, err := m.conn.Write(buf.Bytes())
+	wn, err := m.conn.Write(buf.Bytes())
+	atomic.AddInt64(&m.bytesWritten, int64(wn))
+	return err
+}
 
-	res := make([]byte, 68)
-	n, err := io.ReadFull(m.conn, res)
+// readHandShake 读取并校验对方的握手, 不检查infohash
+// 握手长度及各字段偏移由pstr长度决定: pstrlen(1) + pstr + reserved(8) + info_hash(20) + peer_id(20)
+func (m *Meta) readHandShake() ([]byte, error) {
+	headerLen := len(m.preHeader)
+	res := make([]byte, headerLen+40)
+	n, err := io.ReadFull(m.reader, res)
+	atomic.AddInt64(&m.bytesRead, int64(n))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if n != 68 {
-		return errors.New("hand read len err")
+	if n != len(res) {
+		return nil, errors.New("hand read len err")
 	}
 
-	if !bytes.Equal(res[:20], m.preHeader[:20]) {
-		return errors.New("remote peer not supporting bittorrent protocol")
+	pstrEnd := int(m.preHeader[0]) + 1
+	if !bytes.Equal(res[:pstrEnd], m.preHeader[:pstrEnd]) {
+		return nil, errors.New("remote peer not supporting bittorrent protocol")
 	}
 
-	if res[25]&0x10 != 0x10 {
-		return errors.New("remote peer not supporting extension protocol")
+	if res[pstrEnd+5]&0x10 != 0x10 {
+		return nil, errors.New("remote peer not supporting extension protocol")
 	}
+	return res, nil
+}
 
-	if !bytes.Equal(res[28:48], m.infoHash) {
-		return errors.New("invalid bittorrent header response")
+// retryableHandShake 对方在我们读到任何数据前关闭或重置了连接, infohash不匹配和协议错误不重试
+func (m *Meta) retryableHandShake(err error) bool {
+	if atomic.LoadInt64(&m.bytesRead) != 0 {
+		return false
 	}
-	return nil
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// handShakeHash 对方握手中的infohash
+func (m *Meta) handShakeHash(res []byte) []byte {
+	return res[len(m.preHeader) : len(m.preHeader)+20]
 }
 
 func (this *Meta) onExtHandshake(payload []byte) error {
 
-	dict, err := bencode.Decode(bytes.NewBuffer(payload))
+	dict, err := common.DecodeDict(payload)
 	if err != nil {
 		return err
 	}
 
+	m, ok := dict["m"].(map[string]interface{})
+	if !ok {
+		return ErrNoUtMetadata
+	}
+	extensions := make(map[string]int64, len(m))
+	for name, v := range m {
+		if id, ok := v.(int64); ok {
+			extensions[name] = id
+		}
+	}
+	this.lock.Lock()
+	this.extensions = extensions
+	this.yourIp = extIP(dict["yourip"], 0)
+	this.peerIPv4 = extIP(dict["ipv4"], net.IPv4len)
+	this.peerIPv6 = extIP(dict["ipv6"], net.IPv6len)
+	this.lock.Unlock()
+
+	utMetadata, ok := m["ut_metadata"].(int64)
+	if !ok || utMetadata == 0 {
+		return ErrNoUtMetadata
+	}
+
 	metadataSize, ok := dict["metadata_size"].(int64)
 	if !ok {
-		return errors.New("invalid extension header response")
+		return ErrNoMetadataSize
 	}
 
 	if metadataSize > maxMetadataSize {
@@ -266,34 +946,107 @@ func (this *Meta) onExtHandshake(payload []byte) error {
 		return errors.New("negative metadata_size")
 	}
 
-	m, ok := dict["m"].(map[string]interface{})
-	if !ok {
-		return errors.New("negative metadata m")
+	if this.expectedSize > 0 && metadataSize != this.expectedSize {
+		return fmt.Errorf("%w: got %d, want %d", ErrMetadataSizeMismatch, metadataSize, this.expectedSize)
 	}
-
-	utMetadata, ok := m["ut_metadata"].(int64)
-	if !ok {
-		return errors.New("negative metadata ut_metadata")
+	pieceCount := (metadataSize + perBlock - 1) / perBlock
+	if pieceCount > this.maxPieces {
+		return fmt.Errorf("%w: %d pieces, max %d", ErrTooManyPieces, pieceCount, this.maxPieces)
+	}
+	this.lock.Lock()
+	if v, ok := dict["v"].(string); ok {
+		this.peerClient = v
+	}
+	if reqq, ok := dict["reqq"].(int64); ok && reqq > 0 {
+		this.peerReqq = reqq
 	}
 	this.metadataSize = metadataSize
 	this.utMetadata = utMetadata
-	this.pieceCount = metadataSize / perBlock
-	if this.metadataSize%perBlock != 0 {
-		this.pieceCount++
-	}
+	this.pieceCount = pieceCount
 	this.pieces = make([][]byte, this.pieceCount)
-	this.sendRequestPiece()
+	this.lock.Unlock()
+	if !this.partial && !this.probing {
+		this.sendRequestPiece()
+	}
 	return nil
 }
 
+// extIP 解析扩展握手中的紧凑ip, size为0时4字节和16字节都接受, 长度不对时返回nil
+func extIP(v interface{}, size int) net.IP {
+	s, _ := v.(string)
+	if len(s) != net.IPv4len && len(s) != net.IPv6len || size != 0 && len(s) != size {
+		return nil
+	}
+	return net.IP(s)
+}
+
+// PeerIPs 对方在扩展握手中声明的自己的ipv4和ipv6地址, 没有时为nil, 可用于双栈peer选择地址族
+func (m *Meta) PeerIPs() (ipv4, ipv6 net.IP) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.peerIPv4, m.peerIPv6
+}
+
+// YourIP 对方在扩展握手中看到的我们的地址, 没有时为nil
+func (m *Meta) YourIP() net.IP {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.yourIp
+}
+
+// PeerExtensions 对方扩展握手中声明支持的扩展及其消息id
+func (m *Meta) PeerExtensions() map[string]int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make(map[string]int64, len(m.extensions))
+	for name, id := range m.extensions {
+		ret[name] = id
+	}
+	return ret
+}
+
+// BytesRead 连接上读取的字节数, 包括握手, 可在其他goroutine中调用
+func (m *Meta) BytesRead() int64 {
+	return atomic.LoadInt64(&m.bytesRead)
+}
+
+// BytesWritten 连接上写出的字节数, 包括握手和请求
+func (m *Meta) BytesWritten() int64 {
+	return atomic.LoadInt64(&m.bytesWritten)
+}
+
+// DumpState 返回当前下载状态, 用于排查卡住的下载, 可在其他goroutine中调用
+func (m *Meta) DumpState() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var missing []string
+	received := 0
+	for i, b := range m.pieces {
+		if b == nil {
+			missing = append(missing, fmt.Sprint(i))
+		} else {
+			received++
+		}
+	}
+	return fmt.Sprintf("addr:%s hash:%x client:%q msgs:%d metadata_size:%d ut_metadata:%d pieces:%d/%d missing:[%s]",
+		m.addr, m.infoHash, m.peerClient, m.msgCount, m.metadataSize, m.utMetadata,
+		received, m.pieceCount, strings.Join(missing, ","))
+}
+
 func (mw *Meta) requestPiece(i int) {
 	buf := bytes.NewBuffer(nil)
 	buf.WriteByte(extended)
 	buf.WriteByte(byte(mw.utMetadata))
-	buf.Write(bencode.Encode(map[string]interface{}{
+	//bencode.Encode按key排序输出, 加上total_size后仍是规范的字典
+	req := map[string]interface{}{
 		"msg_type": 0,
 		"piece":    i,
-	}))
+	}
+	if mw.requestTotalSize {
+		req["total_size"] = mw.metadataSize
+	}
+	buf.Write(bencode.Encode(req))
 	err := mw.WriteTo(buf.Bytes())
 	if err != nil {
 		fmt.Println("write err :", err.Error())
@@ -0,0 +1,252 @@
+package load
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marksamman/bencode"
+)
+
+// pipeMeta 连接到一个丢弃所有写入的net.Pipe的Meta, 已完成扩展握手
+func pipeMeta(t *testing.T, metadata []byte, opts ...Option) *Meta {
+	t.Helper()
+	return newPipeMeta(t, metadata, 1, ioutil.Discard, opts...)
+}
+
+// newPipeMeta 对方在扩展握手中声明ut_metadata为utMetadata, 我们发送的字节都复制到w
+func newPipeMeta(t *testing.T, metadata []byte, utMetadata int, w io.Writer, opts ...Option) *Meta {
+	t.Helper()
+	hash := InfoHash(metadata)
+	local, remote := net.Pipe()
+	go io.Copy(w, remote)
+	t.Cleanup(func() { local.Close(); remote.Close() })
+
+	m := NewMeta("pipe", hash[:], opts...)
+	m.conn = local
+	ext := bencode.Encode(map[string]interface{}{
+		"m":             map[string]interface{}{"ut_metadata": utMetadata},
+		"metadata_size": len(metadata),
+	})
+	if err := m.onExtHandshake(ext); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// writes 每次Write的内容发送到通道, net.Pipe上每次Read对应我们的一次Write
+type writes chan []byte
+
+func (w writes) Write(p []byte) (int, error) {
+	w <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+// 用-race运行: 一个goroutine接收piece并请求下一个, 另一个goroutine同时重新请求缺失的piece和读取状态
+func TestConcurrentReceiveAndRequest(t *testing.T) {
+	metadata := testMetadata(5*perBlock + 100)
+	m := pipeMeta(t, metadata, WithMaxInFlightPieces(2))
+	p := &fakePeer{metadata: metadata}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for _, i := range []int64{1, 0, 5, 3, 2, 4} {
+			if _, err := m.readOnePiece(p.piece(i)); err != nil {
+				t.Error(err)
+				return
+			}
+			m.requestNext()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			m.requestMissing()
+			m.DumpState()
+			m.checkDone()
+			m.PeerExtensions()
+			m.BytesWritten()
+		}
+	}()
+	wg.Wait()
+
+	if !m.checkDone() {
+		t.Fatal("not all pieces received")
+	}
+	if got := bytes.Join(m.pieces, nil); !bytes.Equal(got, metadata) {
+		t.Fatal("assembled metadata differs")
+	}
+}
+
+// 与客户端实际发送的请求逐字节比较(长度前缀, 扩展消息id, 对方的ut_metadata id 3, 规范bencode)
+func TestRequestPieceWireFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		//libtorrent, Transmission发送的请求, 与BEP 9的格式相同
+		{"plain", nil, "\x00\x00\x00\x1b\x14\x03d8:msg_typei0e5:piecei0ee"},
+		//旧版本libtorrent需要的total_size
+		{"total_size", []Option{WithTotalSizeInRequest()}, "\x00\x00\x00\x2f\x14\x03d8:msg_typei0e5:piecei0e10:total_sizei40000ee"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := make(writes, 16)
+			//扩展握手后第一个请求是piece 0
+			newPipeMeta(t, testMetadata(40000), 3, w, tt.opts...)
+			select {
+			case got := <-w:
+				if string(got) != tt.want {
+					t.Fatalf("request bytes %q, want %q", got, tt.want)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("no request sent")
+			}
+		})
+	}
+}
+
+// WithPartialFetch时重新请求缺失的piece只请求RequestPieces指定的piece
+func TestRequestMissingPartial(t *testing.T) {
+	w := make(writes, 16)
+	m := newPipeMeta(t, testMetadata(4*perBlock), 1, w, WithPartialFetch(), WithContinueOnPieceError(true))
+	if err := m.RequestPieces([]int{2}); err != nil {
+		t.Fatal(err)
+	}
+	m.requestMissing()
+
+	var got []string
+	for {
+		select {
+		case b := <-w:
+			got = append(got, string(b))
+			continue
+		case <-time.After(200 * time.Millisecond):
+		}
+		break
+	}
+	want := "\x00\x00\x00\x1b\x14\x01d8:msg_typei0e5:piecei2ee"
+	if len(got) != 2 || got[0] != want || got[1] != want {
+		t.Fatalf("requests %q, want piece 2 twice", got)
+	}
+}
+
+// 对方可以发送任意字节, 这些消息都不能被当作piece数据保存
+func TestReadOnePieceRejectsMalformed(t *testing.T) {
+	metadata := testMetadata(2*perBlock + 100)
+	p := &fakePeer{metadata: metadata}
+	dict := func(d map[string]interface{}, data []byte) []byte {
+		return append(bencode.Encode(d), data...)
+	}
+	last := metadata[2*perBlock:]
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"not bencode", []byte("hello")},
+		{"truncated dict", []byte("d8:msg_typei1e5:piecei0e")},
+		{"list", append([]byte("li1ei0ee"), last...)},
+		{"no msg_type", dict(map[string]interface{}{"piece": 2}, last)},
+		{"msg_type string", dict(map[string]interface{}{"msg_type": "1", "piece": 2}, last)},
+		//把我们的请求原样发回来
+		{"echoed request", dict(map[string]interface{}{"msg_type": 0, "piece": 2}, last)},
+		{"reject", dict(map[string]interface{}{"msg_type": 2, "piece": 2}, nil)},
+		{"unknown msg_type", dict(map[string]interface{}{"msg_type": 7, "piece": 2}, last)},
+		{"no piece", dict(map[string]interface{}{"msg_type": 1}, last)},
+		{"piece string", dict(map[string]interface{}{"msg_type": 1, "piece": "2"}, last)},
+		{"negative piece", dict(map[string]interface{}{"msg_type": 1, "piece": -1}, last)},
+		{"piece out of range", dict(map[string]interface{}{"msg_type": 1, "piece": 3}, last)},
+		{"huge piece", dict(map[string]interface{}{"msg_type": 1, "piece": int64(1) << 62}, last)},
+		{"wrong total_size", dict(map[string]interface{}{"msg_type": 1, "piece": 2, "total_size": 1}, last)},
+		{"total_size string", dict(map[string]interface{}{"msg_type": 1, "piece": 2, "total_size": "x"}, last)},
+		{"short piece", dict(map[string]interface{}{"msg_type": 1, "piece": 0}, metadata[:perBlock-1])},
+		{"long piece", dict(map[string]interface{}{"msg_type": 1, "piece": 0}, metadata[:perBlock+1])},
+		{"long last piece", dict(map[string]interface{}{"msg_type": 1, "piece": 2}, append(last, 'x'))},
+		{"no data", dict(map[string]interface{}{"msg_type": 1, "piece": 2}, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := pipeMeta(t, metadata)
+			if _, err := m.readOnePiece(tt.payload); err == nil {
+				t.Fatal("malformed piece accepted")
+			}
+			for i, b := range m.pieces {
+				if b != nil {
+					t.Fatalf("piece %d stored", i)
+				}
+			}
+		})
+	}
+
+	//正确的piece仍然被接受
+	m := pipeMeta(t, metadata)
+	if i, err := m.readOnePiece(p.piece(2)); err != nil || i != 2 {
+		t.Fatalf("valid piece: index %d err %v", i, err)
+	}
+}
+
+// 只解码开头的字典, 多余的key和之后的字节都忽略, 但必需的key仍然校验
+func TestOnExtHandshakeTolerant(t *testing.T) {
+	dict := func(d map[string]interface{}, trailer string) []byte {
+		return append(bencode.Encode(d), trailer...)
+	}
+	valid := map[string]interface{}{
+		"m":             map[string]interface{}{"ut_metadata": 3, "lt_donthave": 7},
+		"metadata_size": 20000,
+		"complete_ago":  1,
+		"upload_only":   1,
+		"x_unknown":     []interface{}{"a", 1},
+	}
+	tests := []struct {
+		name    string
+		payload []byte
+		ok      bool
+	}{
+		{"extra keys", dict(valid, ""), true},
+		{"trailing bytes", dict(valid, "junk"), true},
+		{"trailing dict", dict(valid, "d1:ai1ee"), true},
+		{"trailing nul", dict(valid, "\x00\x00\x00"), true},
+		{"no m", dict(map[string]interface{}{"metadata_size": 20000}, "junk"), false},
+		{"no metadata_size", dict(map[string]interface{}{"m": map[string]interface{}{"ut_metadata": 3}}, "junk"), false},
+		{"truncated", dict(valid, "")[:20], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMeta("127.0.0.1:1", make([]byte, 20))
+			m.probing = true
+			err := m.onExtHandshake(tt.payload)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok=%v", err, tt.ok)
+			}
+			if tt.ok && (m.utMetadata != 3 || m.metadataSize != 20000) {
+				t.Fatalf("ut_metadata %d metadata_size %d", m.utMetadata, m.metadataSize)
+			}
+		})
+	}
+}
+
+// 默认不在扩展握手中发送v
+func TestExtHandshakeVersion(t *testing.T) {
+	hash := make([]byte, 20)
+	if v, ok := NewMeta("127.0.0.1:1", hash).extHandshakeDict()["v"]; ok {
+		t.Fatalf("default handshake sends v %q", v)
+	}
+	if v := NewMeta("127.0.0.1:1", hash, WithClientVersion("test 1.0")).extHandshakeDict()["v"]; v != "test 1.0" {
+		t.Fatalf("v = %v, want the configured version", v)
+	}
+}
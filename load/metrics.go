@@ -0,0 +1,55 @@
+package load
+
+import (
+	"sync"
+)
+
+// Histogram 简单的分桶统计, counts[i]为 <= bounds[i] 的次数, 最后一个桶为超出所有上界的次数
+type Histogram struct {
+	lock   sync.Mutex
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []int64
+	Sum    float64
+	Count  int64
+}
+
+func NewHistogram(bounds ...float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	counts := make([]int64, len(h.counts))
+	copy(counts, h.counts)
+	return HistogramSnapshot{Bounds: h.bounds, Counts: counts, Sum: h.sum, Count: h.count}
+}
+
+var (
+	// FetchDuration 成功下载metadata的总耗时, 单位秒
+	FetchDuration = NewHistogram(0.5, 1, 2, 5, 10, 20, 30, 60)
+	// FetchPeersTried 成功下载前尝试过的peer数
+	FetchPeersTried = NewHistogram(1, 2, 3, 5, 10, 20, 50)
+)
@@ -0,0 +1,267 @@
+package load
+
+import (
+	"DHTsimple/common"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type Option func(*Meta)
+
+// WithReqq 扩展握手中告知对方我们的请求队列长度
+func WithReqq(n int) Option {
+	return func(m *Meta) {
+		m.reqq = n
+	}
+}
+
+// WithClientVersion 扩展握手中的客户端版本字符串 v, 默认为SetFingerprint设置的Version, 为空时不发送
+func WithClientVersion(v string) Option {
+	return func(m *Meta) {
+		m.clientVersion = v
+	}
+}
+
+// WithListenPort 扩展握手中告知对方我们的监听端口 p
+func WithListenPort(port int) Option {
+	return func(m *Meta) {
+		m.listenPort = port
+	}
+}
+
+// WithMaxMessageSize 限制单条消息的最大长度, 0 为不限制
+func WithMaxMessageSize(n int) Option {
+	return func(m *Meta) {
+		if n != 0 && n < minMessageSize {
+			m.optErr = fmt.Errorf("max message size must be at least %d", minMessageSize)
+			return
+		}
+		m.maxMessageSize = n
+	}
+}
+
+// WithReadBufferSize 读缓冲区大小
+func WithReadBufferSize(n int) Option {
+	return func(m *Meta) {
+		if n <= 0 {
+			m.optErr = errors.New("read buffer size must be positive")
+			return
+		}
+		m.readBufferSize = n
+	}
+}
+
+// WithBreaker 使用按ip熔断, 多个Meta共享同一个Breaker
+func WithBreaker(b *Breaker) Option {
+	return func(m *Meta) {
+		m.breaker = b
+	}
+}
+
+// WithKeepAlive 开启tcp keepalive, 并在连接空闲interval后发送bt keep-alive消息, 0为关闭(默认)
+// 从握手完成开始发送, Begin结束后停止; WithKeepOpen时一直发送到TakeConn或Close
+func WithKeepAlive(interval time.Duration) Option {
+	return func(m *Meta) {
+		if interval < 0 {
+			m.optErr = errors.New("keep-alive interval must not be negative")
+			return
+		}
+		m.keepAlive = interval
+	}
+}
+
+// WithResolver 指定域名解析及缓存, 默认使用DefaultResolver
+func WithResolver(r *Resolver) Option {
+	return func(m *Meta) {
+		m.resolver = r
+	}
+}
+
+// WithProtocol 自定义握手中的协议字符串pstr, 默认为"BitTorrent protocol"
+func WithProtocol(pstr string) Option {
+	return func(m *Meta) {
+		if len(pstr) == 0 || len(pstr) > 255 {
+			m.optErr = errors.New("protocol string length must be in 1-255")
+			return
+		}
+		m.preHeader = common.MakePreHeaderWithProtocol(pstr)
+	}
+}
+
+// WithKeepOpen 下载完成后不关闭连接, 调用者通过TakeConn取得连接并负责关闭
+func WithKeepOpen() Option {
+	return func(m *Meta) {
+		m.keepOpen = true
+	}
+}
+
+// WithDeadPeerCache Connect失败的地址记入c, ttl内再次连接直接返回ErrRecentlyFailed
+func WithDeadPeerCache(c *DeadPeerCache) Option {
+	return func(m *Meta) {
+		m.deadPeers = c
+	}
+}
+
+// WithEvents 把下载过程中的事件发送到ch, ch应带缓冲, 满时事件被丢弃
+func WithEvents(ch chan<- Event) Option {
+	return func(m *Meta) {
+		m.events = ch
+	}
+}
+
+// WithMaxBufferedPieces BeginTo最多缓存的乱序piece数, 超过时返回ErrReorderBufferExceeded, 0为不限制
+func WithMaxBufferedPieces(n int) Option {
+	return func(m *Meta) {
+		if n < 0 {
+			m.optErr = errors.New("max buffered pieces must not be negative")
+			return
+		}
+		m.maxBufferedPieces = n
+	}
+}
+
+// WithContinueOnPieceError 单个piece解析失败时重新请求缺失的piece而不是结束下载, 最多重试maxPieceRetries次
+func WithContinueOnPieceError(b bool) Option {
+	return func(m *Meta) {
+		m.continueOnPieceError = b
+	}
+}
+
+// WithContext 取消ctx时中止限速等待等阻塞操作
+func WithContext(ctx context.Context) Option {
+	return func(m *Meta) {
+		m.ctx = ctx
+	}
+}
+
+// WithBandwidthLimit 限制单个连接的读写速度, 字节/秒
+func WithBandwidthLimit(bytesPerSec int) Option {
+	return func(m *Meta) {
+		if bytesPerSec <= 0 {
+			m.optErr = errors.New("bandwidth limit must be positive")
+			return
+		}
+		m.limiters = append(m.limiters, NewBandwidthLimiter(bytesPerSec))
+	}
+}
+
+// WithSharedBandwidthLimiter 多个连接共享的限速器, 用于限制总带宽
+func WithSharedBandwidthLimiter(l *rate.Limiter) Option {
+	return func(m *Meta) {
+		m.limiters = append(m.limiters, l)
+	}
+}
+
+// WithDialLimiter 每次拨号前从l取得令牌, l可以与DHT共享(见common.NewLimiter)
+func WithDialLimiter(l *rate.Limiter) Option {
+	return func(m *Meta) {
+		m.dialLimiter = l
+	}
+}
+
+// WithPartialFetch 扩展握手后不自动请求所有piece, 由调用者通过RequestPieces指定
+func WithPartialFetch() Option {
+	return func(m *Meta) {
+		m.partial = true
+	}
+}
+
+// WithClock 替换计时和keep-alive空闲判断使用的时间来源, 连接的读写deadline仍使用系统时间
+func WithClock(c common.Clock) Option {
+	return func(m *Meta) {
+		m.clock = c
+	}
+}
+
+// WithHandShakeRetry 对方在握手时直接关闭或重置连接时, 等待delay后重连并再握手一次
+func WithHandShakeRetry(delay time.Duration) Option {
+	return func(m *Meta) {
+		m.handShakeRetry = delay
+	}
+}
+
+// WithExpectedMetadataSize 对方给出的metadata_size与size不同时返回ErrMetadataSizeMismatch, 用于续传
+func WithExpectedMetadataSize(size int64) Option {
+	return func(m *Meta) {
+		m.expectedSize = size
+	}
+}
+
+// WithTotalSizeInRequest piece请求中附带total_size, 一些旧版本libtorrent需要
+func WithTotalSizeInRequest() Option {
+	return func(m *Meta) {
+		m.requestTotalSize = true
+	}
+}
+
+// WithHasDataCheck Begin下载metadata后发送interested并读取对方的bitfield, 结果见HasData, 会多一次往返
+func WithHasDataCheck() Option {
+	return func(m *Meta) {
+		m.checkData = true
+	}
+}
+
+// WithPeerIDGenerator 每次连接时调用gen生成握手使用的peer id, 默认按SetFingerprint设置的前缀生成
+func WithPeerIDGenerator(gen func() string) Option {
+	return func(m *Meta) {
+		if gen == nil {
+			m.optErr = errors.New("nil peer id generator")
+			return
+		}
+		m.peerIdGen = gen
+	}
+}
+
+// WithSkipChecksum 仅用于调试和分析损坏的种子: sha1与infohash不同时Begin仍返回拼接的数据,
+// 不返回ErrChecksumMismatch, 见ChecksumMismatch. 不要在生产环境中使用
+func WithSkipChecksum() Option {
+	return func(m *Meta) {
+		m.skipChecksum = true
+	}
+}
+
+// WithFetchTimeout Begin下载metadata的总时间, 超时后读写都会失败, 默认使用配置中的read_timeout和write_timeout
+func WithFetchTimeout(d time.Duration) Option {
+	return func(m *Meta) {
+		if d <= 0 {
+			m.optErr = errors.New("fetch timeout must be positive")
+			return
+		}
+		m.fetchTimeout = d
+	}
+}
+
+// WithMaxPieces metadata最多的piece数, 超过时Connect返回ErrTooManyPieces, 默认为metadata_size上限对应的1024
+func WithMaxPieces(n int) Option {
+	return func(m *Meta) {
+		if n <= 0 {
+			m.optErr = errors.New("max pieces must be positive")
+			return
+		}
+		m.maxPieces = int64(n)
+	}
+}
+
+// WithMaxInFlightPieces 同时请求的piece数上限, 对方在扩展握手中给出reqq时取两者中较小的, 默认只受reqq限制
+func WithMaxInFlightPieces(n int) Option {
+	return func(m *Meta) {
+		if n <= 0 {
+			m.optErr = errors.New("max in-flight pieces must be positive")
+			return
+		}
+		m.maxInFlight = n
+	}
+}
+
+// AddressFamily RaceMetadataByFamily优先尝试的地址族
+type AddressFamily int
+
+const (
+	NoPreference AddressFamily = iota
+	PreferIPv4
+	PreferIPv6
+)
@@ -0,0 +1,64 @@
+package load
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+)
+
+const (
+	compactPeerLen   = 6
+	compactPeer6Len  = 18
+	compactPortBytes = 2
+)
+
+// ParseCompactPeers 解析tracker/DHT返回的紧凑格式peer列表, ipv4每项6字节, ipv6每项18字节
+func ParseCompactPeers(b []byte, ipv6 bool) ([]string, error) {
+	size := compactPeerLen
+	if ipv6 {
+		size = compactPeer6Len
+	}
+	if len(b)%size != 0 {
+		return nil, errors.New("compact peers length error")
+	}
+
+	peers := make([]string, 0, len(b)/size)
+	for i := 0; i < len(b); i += size {
+		ipLen := size - compactPortBytes
+		port := binary.BigEndian.Uint16(b[i+ipLen : i+size])
+		if port == 0 {
+			continue
+		}
+		ip := net.IP(b[i : i+ipLen]).String()
+		peers = append(peers, net.JoinHostPort(ip, strconv.Itoa(int(port))))
+	}
+	return peers, nil
+}
+
+// orderByFamily 把pref地址族的peer稳定地排到前面, 域名和无法解析的地址排在另一个地址族之前
+func orderByFamily(peers []string, pref AddressFamily) []string {
+	if pref == NoPreference {
+		return peers
+	}
+	rank := func(addr string) int {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return 1
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return 1
+		}
+		if (ip.To4() != nil) == (pref == PreferIPv4) {
+			return 0
+		}
+		return 2
+	}
+	ret := append([]string(nil), peers...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return rank(ret[i]) < rank(ret[j])
+	})
+	return ret
+}
@@ -0,0 +1,9 @@
+//go:build !go1.18
+// +build !go1.18
+
+package load
+
+// decodePeers go1.18之前没有net/netip, 使用ParseCompactPeers
+func decodePeers(b []byte, ipv6 bool) ([]string, error) {
+	return ParseCompactPeers(b, ipv6)
+}
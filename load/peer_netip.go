@@ -0,0 +1,61 @@
+//go:build go1.18
+// +build go1.18
+
+package load
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+// DecodeCompactPeers 与ParseCompactPeers相同, 但返回netip.AddrPort, 缓存大量peer时不需要为每个peer分配字符串
+func DecodeCompactPeers(b []byte) ([]netip.AddrPort, error) {
+	return decodeCompactPeers(b, compactPeerLen)
+}
+
+// DecodeCompactPeers6 ipv6的紧凑格式peer列表, 每项18字节
+func DecodeCompactPeers6(b []byte) ([]netip.AddrPort, error) {
+	return decodeCompactPeers(b, compactPeer6Len)
+}
+
+func decodeCompactPeers(b []byte, size int) ([]netip.AddrPort, error) {
+	if len(b)%size != 0 {
+		return nil, errors.New("compact peers length error")
+	}
+
+	peers := make([]netip.AddrPort, 0, len(b)/size)
+	for i := 0; i < len(b); i += size {
+		ipLen := size - compactPortBytes
+		port := binary.BigEndian.Uint16(b[i+ipLen : i+size])
+		if port == 0 {
+			continue
+		}
+		ip, _ := netip.AddrFromSlice(b[i : i+ipLen])
+		//与ParseCompactPeers一致, ipv4映射的ipv6地址按ipv4处理
+		peers = append(peers, netip.AddrPortFrom(ip.Unmap(), port))
+	}
+	return peers, nil
+}
+
+// PeerAddrs 转换为NewMeta和FetchMetadata使用的host:port字符串
+func PeerAddrs(peers []netip.AddrPort) []string {
+	ret := make([]string, 0, len(peers))
+	for _, p := range peers {
+		ret = append(ret, p.String())
+	}
+	return ret
+}
+
+// decodePeers tracker返回的peers/peers6使用netip解析
+func decodePeers(b []byte, ipv6 bool) ([]string, error) {
+	decode := DecodeCompactPeers
+	if ipv6 {
+		decode = DecodeCompactPeers6
+	}
+	peers, err := decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return PeerAddrs(peers), nil
+}
@@ -0,0 +1,55 @@
+//go:build go1.18
+
+package load
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeCompactPeers(t *testing.T) {
+	v6 := netip.MustParseAddr("2001:db8::1").As16()
+	mapped := netip.MustParseAddr("::ffff:10.0.0.2").As16()
+	tests := []struct {
+		name  string
+		in    []byte
+		ipv6  bool
+		want  []string
+		isErr bool
+	}{
+		{name: "ipv4", in: []byte{10, 0, 0, 1, 0x1a, 0xe1, 192, 168, 1, 2, 0, 80}, want: []string{"10.0.0.1:6881", "192.168.1.2:80"}},
+		{name: "ipv4 port 0 skipped", in: []byte{10, 0, 0, 1, 0, 0}, want: []string{}},
+		{name: "ipv6", in: append(v6[:], 0x1a, 0xe1), ipv6: true, want: []string{"[2001:db8::1]:6881"}},
+		{name: "ipv4 mapped ipv6", in: append(mapped[:], 0x1a, 0xe1), ipv6: true, want: []string{"10.0.0.2:6881"}},
+		{name: "empty", in: nil, want: []string{}},
+		{name: "ipv4 truncated", in: []byte{10, 0, 0, 1, 0x1a}, isErr: true},
+		{name: "ipv6 truncated", in: v6[:], ipv6: true, isErr: true},
+		{name: "ipv4 list as ipv6", in: []byte{10, 0, 0, 1, 0x1a, 0xe1}, ipv6: true, isErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decode := DecodeCompactPeers
+			if tt.ipv6 {
+				decode = DecodeCompactPeers6
+			}
+			peers, err := decode(tt.in)
+			if tt.isErr {
+				if err == nil {
+					t.Fatalf("decoded %v from truncated input", peers)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := PeerAddrs(peers); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			//与不使用netip的ParseCompactPeers结果相同
+			if old, _ := ParseCompactPeers(tt.in, tt.ipv6); !reflect.DeepEqual(old, tt.want) {
+				t.Fatalf("ParseCompactPeers got %v, want %v", old, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package load
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+// defaultPeerIDPrefix Azureus风格的客户端前缀
+const defaultPeerIDPrefix = "-DS0001-"
+
+const peerIDChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// NewPeerIDGenerator 返回的函数每次生成一个以prefix开头, 其余为随机字母数字的20字节peer id
+// prefix超过20字节时被截断
+func NewPeerIDGenerator(prefix string) func() string {
+	if len(prefix) > 20 {
+		prefix = prefix[:20]
+	}
+	return func() string {
+		b := make([]byte, 20)
+		copy(b, prefix)
+		rnd := make([]byte, 20-len(prefix))
+		if _, err := rand.Read(rnd); err != nil {
+			fmt.Printf("rand peer id err:%s\n", err.Error())
+			panic(err)
+		}
+		for i, v := range rnd {
+			b[len(prefix)+i] = peerIDChars[int(v)%len(peerIDChars)]
+		}
+		return string(b)
+	}
+}
+
+// DefaultPeerIDGenerator 默认每次连接使用新的随机peer id, 避免整个爬取过程使用同一个id被识别
+var DefaultPeerIDGenerator = NewPeerIDGenerator(defaultPeerIDPrefix)
+
+// ClientFingerprint 我们对外表明的客户端身份, 同时用于peer id, 扩展握手的v和http tracker的User-Agent
+type ClientFingerprint struct {
+	//Azureus风格的peer id前缀, 如"-DS0001-"
+	PeerIDPrefix string
+	//扩展握手中的v, 为空时不发送
+	Version string
+	//http tracker请求的User-Agent, 为空时使用Go的默认值
+	UserAgent string
+}
+
+// DefaultFingerprint 默认的客户端身份, 不发送v, 需要时用SetFingerprint或WithClientVersion设置
+var DefaultFingerprint = ClientFingerprint{
+	PeerIDPrefix: defaultPeerIDPrefix,
+	UserAgent:    "DHTsimple/0.1",
+}
+
+var (
+	fingerprintLock sync.Mutex
+	fingerprint     = DefaultFingerprint
+)
+
+// SetFingerprint 设置之后创建的Meta和tracker请求使用的客户端身份, 单个Meta可以再用WithPeerIDGenerator/WithClientVersion覆盖
+func SetFingerprint(fp ClientFingerprint) {
+	fingerprintLock.Lock()
+	fingerprint = fp
+	fingerprintLock.Unlock()
+}
+
+func currentFingerprint() ClientFingerprint {
+	fingerprintLock.Lock()
+	defer fingerprintLock.Unlock()
+	return fingerprint
+}
+
+// peerIDGenerator 前缀为默认值时共用DefaultPeerIDGenerator
+func (fp ClientFingerprint) peerIDGenerator() func() string {
+	if fp.PeerIDPrefix == defaultPeerIDPrefix {
+		return DefaultPeerIDGenerator
+	}
+	return NewPeerIDGenerator(fp.PeerIDPrefix)
+}
+
+// FingerprintPeerID 按当前客户端身份生成一个peer id, 用于tracker announce
+func FingerprintPeerID() string {
+	return currentFingerprint().peerIDGenerator()()
+}
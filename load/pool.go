@@ -0,0 +1,114 @@
+package load
+
+import (
+	"DHTsimple/config"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrPoolClosed = errors.New("pool closed")
+
+// Pool 为常用的peer(如自己的种子服务器)预先建立tcp连接, 省去每个infohash的连接耗时
+// bt连接握手后绑定一个infohash, 所以连接只能使用一次, Get之后会在后台补充新的连接
+type Pool struct {
+	lock    sync.Mutex
+	size    int
+	idle    map[string][]net.Conn
+	filling map[string]bool
+	closed  bool
+}
+
+func NewPool(size int) *Pool {
+	return &Pool{
+		size:    size,
+		idle:    make(map[string][]net.Conn),
+		filling: make(map[string]bool),
+	}
+}
+
+func (p *Pool) dial(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, time.Duration(config.Conf.ConnectTimeout)*time.Second)
+}
+
+// Get 取一个未握手的连接, 没有空闲连接时直接建立, 每个addr同时最多有一个后台补充
+func (p *Pool) Get(addr string) (net.Conn, error) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, ErrPoolClosed
+	}
+	conns := p.idle[addr]
+	var conn net.Conn
+	if len(conns) > 0 {
+		conn = conns[len(conns)-1]
+		p.idle[addr] = conns[:len(conns)-1]
+	}
+	if !p.filling[addr] {
+		p.filling[addr] = true
+		go p.fill(addr)
+	}
+	p.lock.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+	return p.dial(addr)
+}
+
+// fill 补充addr的空闲连接直到size个, 由Get在设置filling[addr]后启动
+func (p *Pool) fill(addr string) {
+	defer func() {
+		p.lock.Lock()
+		delete(p.filling, addr)
+		p.lock.Unlock()
+	}()
+
+	for {
+		p.lock.Lock()
+		full := p.closed || len(p.idle[addr]) >= p.size
+		p.lock.Unlock()
+		if full {
+			return
+		}
+
+		conn, err := p.dial(addr)
+		if err != nil {
+			return
+		}
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			conn.Close()
+			return
+		}
+		p.idle[addr] = append(p.idle[addr], conn)
+		p.lock.Unlock()
+	}
+}
+
+func (p *Pool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	for addr, conns := range p.idle {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(p.idle, addr)
+	}
+}
+
+// UseConn 在已建立的连接(如Pool.Get返回的)上完成握手和扩展握手, 失败时关闭该连接
+func (m *Meta) UseConn(conn net.Conn) error {
+	m.start = m.clock.Now()
+	m.conn = conn
+	err := m.negotiate(nil)
+	if err != nil {
+		m.Close()
+		return err
+	}
+	m.startKeepAlive()
+	return nil
+}
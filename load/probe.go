@@ -0,0 +1,35 @@
+package load
+
+import (
+	"context"
+	"net"
+)
+
+// ProbeResult 扩展握手中得到的信息
+type ProbeResult struct {
+	MetadataSize int64
+	//对方的ut_metadata扩展id, 我们发送请求时使用
+	UtMetadata int64
+	Client     string
+	//对方声明的自己的地址, 没有时为nil
+	IPv4 net.IP
+	IPv6 net.IP
+	//对方看到的我们的地址
+	YourIP net.IP
+}
+
+// Probe 只完成握手和扩展握手, 不请求任何piece, 返回后连接已关闭
+// 失败时返回与Connect相同的错误, 配合WithEvents可以按阶段统计
+func (m *Meta) Probe(ctx context.Context) (*ProbeResult, error) {
+	m.ctx = ctx
+	m.probing = true
+	defer m.Close()
+	if err := m.Connect(); err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return &ProbeResult{MetadataSize: m.metadataSize, UtMetadata: m.utMetadata, Client: m.peerClient,
+		IPv4: m.peerIPv4, IPv6: m.peerIPv6, YourIP: m.yourIp}, nil
+}
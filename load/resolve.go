@@ -0,0 +1,80 @@
+package load
+
+import (
+	"DHTsimple/common"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+type resolveEntry struct {
+	ip      string
+	expires time.Time
+}
+
+// Resolver 把addr中的域名解析为ip, 结果缓存ttl时间
+type Resolver struct {
+	lock     sync.Mutex
+	ttl      time.Duration
+	cache    map[string]resolveEntry
+	clock    common.Clock
+	Resolver *net.Resolver
+}
+
+var DefaultResolver = NewResolver(time.Minute)
+
+func NewResolver(ttl time.Duration) *Resolver {
+	return &Resolver{
+		ttl:      ttl,
+		cache:    make(map[string]resolveEntry),
+		clock:    common.RealClock,
+		Resolver: net.DefaultResolver,
+	}
+}
+
+func (r *Resolver) SetClock(c common.Clock) {
+	r.lock.Lock()
+	r.clock = c
+	r.lock.Unlock()
+}
+
+// Resolve 返回ip:port形式的地址, addr本身就是ip时直接返回
+func (r *Resolver) Resolve(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	r.lock.Lock()
+	e, ok := r.cache[host]
+	now := r.clock.Now()
+	r.lock.Unlock()
+	if ok && now.Before(e.expires) {
+		return net.JoinHostPort(e.ip, port), nil
+	}
+
+	ips, err := r.Resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", errors.New("no address for host " + host)
+	}
+	ip := ips[0].IP
+	for _, v := range ips {
+		if v.IP.To4() != nil {
+			ip = v.IP
+			break
+		}
+	}
+
+	r.lock.Lock()
+	r.cache[host] = resolveEntry{ip: ip.String(), expires: r.clock.Now().Add(r.ttl)}
+	r.lock.Unlock()
+	return net.JoinHostPort(ip.String(), port), nil
+}
@@ -0,0 +1,194 @@
+package load
+
+import (
+	"DHTsimple/common"
+	"DHTsimple/config"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/marksamman/bencode"
+)
+
+const (
+	msgRequest = 0
+	msgData    = 1
+	msgReject  = 2
+	//我们在扩展握手中声明的ut_metadata消息id, 对方发给我们的ut_metadata消息使用这个id,
+	//我们发给对方的消息使用对方声明的id(Meta.utMetadata), 两者可以不同
+	ourUtMetadata = 1
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+// Server 接受其他peer的bt连接, 对Interested的infohash完成握手并提供Store中的metadata
+type Server struct {
+	Addr       string
+	Store      MetadataStore
+	Interested func(hash []byte) bool
+
+	lock     sync.Mutex
+	listener net.Listener
+	closed   bool
+}
+
+func NewServer(addr string, store MetadataStore) *Server {
+	return &Server{
+		Addr:       addr,
+		Store:      store,
+		Interested: store.Has,
+	}
+}
+
+// ListenAndServe 一直接受连接, Close之后返回ErrServerClosed
+func (s *Server) ListenAndServe() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return ErrServerClosed
+	}
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	s.listener = listener
+	s.lock.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close 停止接受新连接, 先于ListenAndServe调用时ListenAndServe直接返回
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func (s *Server) handle(conn net.Conn) {
+	m := NewMeta(conn.RemoteAddr().String(), nil)
+	m.conn = conn
+	m.reader = bufio.NewReaderSize(conn, m.readBufferSize)
+	defer m.Close()
+
+	m.SetDeadLine(config.Conf.HandTimeout, config.Conf.HandTimeout)
+	err := m.acceptHandShake(s.Interested)
+	if err != nil {
+		return
+	}
+	m.serveData, _ = s.Store.Get(m.infoHash)
+	err = m.WriteTo(append([]byte{extended, extHandshake}, bencode.Encode(m.extHandshakeDict())...))
+	if err != nil {
+		return
+	}
+
+	m.SetDeadLine(config.Conf.ReadTimeout, config.Conf.WriteTimeout)
+	err = m.serveMetadata()
+	if err != nil && err != io.EOF {
+		fmt.Printf("serve %s err:%s\n", m.addr, err.Error())
+	}
+}
+
+// acceptHandShake 被动方的握手: 先读对方握手, 确认infohash后再回复握手
+func (m *Meta) acceptHandShake(interested func(hash []byte) bool) error {
+	res, err := m.readHandShake()
+	if err != nil {
+		return err
+	}
+	hash := m.handShakeHash(res)
+	if !interested(hash) {
+		return errors.New("not interested in info hash")
+	}
+	m.infoHash = append([]byte(nil), hash...)
+
+	return m.writeHandShake()
+}
+
+// serveMetadata 响应对方的ut_metadata请求, 直到连接出错或关闭
+func (m *Meta) serveMetadata() error {
+	for {
+		data, err := m.ReadN()
+		if err != nil {
+			return err
+		}
+		if len(data) < 2 || data[0] != extended {
+			continue
+		}
+
+		if data[1] == extHandshake {
+			dict, err := common.DecodeDict(data[2:])
+			if err != nil {
+				return err
+			}
+			if ext, ok := dict["m"].(map[string]interface{}); ok {
+				if id, ok := ext["ut_metadata"].(int64); ok {
+					m.utMetadata = id
+				}
+			}
+			continue
+		}
+
+		if data[1] != ourUtMetadata || m.utMetadata == 0 {
+			continue
+		}
+		dict, err := common.DecodeDict(data[2:])
+		if err != nil {
+			return err
+		}
+		msgType, _ := dict["msg_type"].(int64)
+		piece, ok := dict["piece"].(int64)
+		if msgType != msgRequest || !ok {
+			continue
+		}
+		err = m.sendPiece(int(piece))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *Meta) sendPiece(piece int) error {
+	//先检查piece再计算偏移, 很大的piece会使乘法溢出
+	if piece < 0 || piece >= (len(m.serveData)+perBlock-1)/perBlock {
+		return m.WriteTo(append([]byte{extended, byte(m.utMetadata)}, bencode.Encode(map[string]interface{}{
+			"msg_type": msgReject,
+			"piece":    piece,
+		})...))
+	}
+	begin := piece * perBlock
+	end := begin + perBlock
+	if end > len(m.serveData) {
+		end = len(m.serveData)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(extended)
+	buf.WriteByte(byte(m.utMetadata))
+	buf.Write(bencode.Encode(map[string]interface{}{
+		"msg_type":   msgData,
+		"piece":      piece,
+		"total_size": len(m.serveData),
+	}))
+	buf.Write(m.serveData[begin:end])
+	return m.WriteTo(buf.Bytes())
+}
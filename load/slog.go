@@ -0,0 +1,36 @@
+//go:build go1.21
+// +build go1.21
+
+package load
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+)
+
+// WithSlog 把下载过程中的事件记录到l, 失败为Warn级别, 其余为Debug级别
+// 属性包括infohash, peer, 失败时的phase和error
+func WithSlog(l *slog.Logger) Option {
+	return func(m *Meta) {
+		m.logEvent = func(ev Event) {
+			level := slog.LevelDebug
+			attrs := []slog.Attr{
+				slog.String("infohash", hex.EncodeToString(ev.InfoHash)),
+				slog.String("peer", ev.Addr),
+			}
+			switch ev.Type {
+			case EventExtHandshaked:
+				attrs = append(attrs, slog.Int64("metadata_size", ev.MetadataSize), slog.Int64("pieces", ev.Pieces))
+			case EventPieceReceived:
+				attrs = append(attrs, slog.Int("piece", ev.Piece))
+			case EventCompleted:
+				attrs = append(attrs, slog.Duration("duration", ev.Duration))
+			case EventFailed:
+				level = slog.LevelWarn
+				attrs = append(attrs, slog.String("phase", string(ev.Phase)), slog.Any("error", ev.Err))
+			}
+			l.LogAttrs(context.Background(), level, "metadata "+ev.Type.String(), attrs...)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package load
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// PeerSource 为infohash提供候选peer, 如DHT, tracker, 见FetchFromSource
+type PeerSource interface {
+	// Peers 返回的channel在没有更多peer时关闭, ctx结束后实现应停止发送并关闭channel
+	Peers(ctx context.Context, infoHash [20]byte) (<-chan net.Addr, error)
+}
+
+// PeerAddr host:port形式的peer地址, 不需要解析域名
+type PeerAddr string
+
+func (a PeerAddr) Network() string { return "tcp" }
+func (a PeerAddr) String() string  { return string(a) }
+
+// StaticPeers 固定的peer列表
+type StaticPeers []string
+
+func (s StaticPeers) Peers(ctx context.Context, infoHash [20]byte) (<-chan net.Addr, error) {
+	ch := make(chan net.Addr, len(s))
+	for _, p := range s {
+		ch <- PeerAddr(p)
+	}
+	close(ch)
+	return ch, nil
+}
+
+// TrackerSource 向一个http(s)或udp tracker announce, PeerID为空时使用FingerprintPeerID
+type TrackerSource struct {
+	URL    string
+	PeerID string
+	Port   int
+}
+
+func (t TrackerSource) Peers(ctx context.Context, infoHash [20]byte) (<-chan net.Addr, error) {
+	peerID := t.PeerID
+	if peerID == "" {
+		peerID = FingerprintPeerID()
+	}
+	ch := make(chan net.Addr)
+	go func() {
+		defer close(ch)
+		peers, err := Announce(ctx, t.URL, infoHash, peerID, t.Port)
+		if err != nil {
+			fmt.Printf("announce to %s err:%s\n", t.URL, err.Error())
+			return
+		}
+		sendPeers(ctx, ch, peers)
+	}()
+	return ch, nil
+}
+
+// sendPeers 把peers依次发送到ch, ctx结束时停止
+func sendPeers(ctx context.Context, ch chan<- net.Addr, peers []string) {
+	for _, p := range peers {
+		select {
+		case ch <- PeerAddr(p):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// MultiSource 同时从多个来源取peer, 按到达顺序合并, 不去重(FetchFromSource会跳过重复的地址)
+// 部分来源出错时忽略, 全部出错时返回最后一个错误
+type MultiSource []PeerSource
+
+func (s MultiSource) Peers(ctx context.Context, infoHash [20]byte) (<-chan net.Addr, error) {
+	out := make(chan net.Addr)
+	var wg sync.WaitGroup
+	var err error
+	started := 0
+	for _, src := range s {
+		ch, e := src.Peers(ctx, infoHash)
+		if e != nil {
+			fmt.Printf("peer source %T err:%s\n", src, e.Error())
+			err = e
+			continue
+		}
+		started++
+		wg.Add(1)
+		go func(ch <-chan net.Addr) {
+			defer wg.Done()
+			for addr := range ch {
+				select {
+				case out <- addr:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(ch)
+	}
+	if started == 0 && err != nil {
+		return nil, err
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out, nil
+}
@@ -0,0 +1,58 @@
+package load
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// RequestPieces 只请求指定的piece, 在Connect之后、Begin之前调用
+// 之后Begin在这些piece到齐时返回它们按顺序拼接的数据, 不做sha1校验, Incomplete()为true
+// 适合只取piece 0预览小种子的名字和文件列表
+func (m *Meta) RequestPieces(indices []int) error {
+	if len(indices) == 0 {
+		return errors.New("no pieces requested")
+	}
+	m.lock.Lock()
+	for _, i := range indices {
+		if i < 0 || int64(i) >= m.pieceCount {
+			m.lock.Unlock()
+			return fmt.Errorf("piece %d out of range", i)
+		}
+	}
+	m.wanted = append(m.wanted, indices...)
+	m.lock.Unlock()
+
+	for _, i := range indices {
+		m.requestPiece(i)
+	}
+	return nil
+}
+
+// Incomplete Begin返回的是否只是部分piece
+func (m *Meta) Incomplete() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.incomplete
+}
+
+// wantedDone 请求的部分piece是否都已收到, 收到时返回拼接后的数据
+func (m *Meta) wantedDone() ([]byte, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	buf := bytes.NewBuffer(nil)
+	done := make(map[int]bool)
+	for _, i := range m.wanted {
+		if m.pieces[i] == nil {
+			return nil, false
+		}
+		done[i] = true
+	}
+	for i := range m.pieces {
+		if done[i] {
+			buf.Write(m.pieces[i])
+		}
+	}
+	m.incomplete = len(done) < len(m.pieces)
+	return buf.Bytes(), true
+}
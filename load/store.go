@@ -0,0 +1,62 @@
+package load
+
+import (
+	"sync"
+)
+
+// MetadataStore 按infohash保存原始metadata(info字典的bencode字节)
+type MetadataStore interface {
+	Get(hash []byte) ([]byte, bool)
+	Put(hash []byte, data []byte)
+	Has(hash []byte) bool
+}
+
+// MemoryStore 内存实现, maxEntries > 0 时按写入顺序淘汰最早的条目
+type MemoryStore struct {
+	lock       sync.RWMutex
+	data       map[string][]byte
+	order      []string
+	maxEntries int
+}
+
+func NewMemoryStore(maxEntries int) *MemoryStore {
+	return &MemoryStore{
+		data:       make(map[string][]byte),
+		maxEntries: maxEntries,
+	}
+}
+
+func (s *MemoryStore) Get(hash []byte) ([]byte, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	data, ok := s.data[string(hash)]
+	return data, ok
+}
+
+func (s *MemoryStore) Has(hash []byte) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok := s.data[string(hash)]
+	return ok
+}
+
+func (s *MemoryStore) Put(hash []byte, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := string(hash)
+	if _, ok := s.data[key]; !ok {
+		s.order = append(s.order, key)
+	}
+	s.data[key] = data
+
+	for s.maxEntries > 0 && len(s.order) > s.maxEntries {
+		delete(s.data, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func (s *MemoryStore) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.data)
+}
@@ -0,0 +1,73 @@
+package load
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+)
+
+var ErrReorderBufferExceeded = errors.New("too many out of order pieces buffered")
+
+// BeginTo 与Begin相同, 但按顺序把metadata写入w而不是整体返回
+// 乱序到达的piece会缓存到前面的piece到齐, 缓存数量受WithMaxBufferedPieces限制
+// 校验失败时已写入w的数据无效, 由调用者丢弃
+func (m *Meta) BeginTo(w io.Writer) (int64, error) {
+	n, err := m.beginTo(w)
+	if err != nil {
+		return n, m.fail(PhaseFetch, err)
+	}
+	m.emit(Event{Type: EventCompleted, Duration: m.clock.Now().Sub(m.start)})
+	return n, nil
+}
+
+func (m *Meta) beginTo(w io.Writer) (int64, error) {
+	defer m.startFetch()()
+
+	hash := sha1.New()
+	next := 0
+	var written int64
+	for next < int(m.pieceCount) {
+		index, err := m.nextPiece()
+		if err != nil {
+			return written, err
+		}
+		m.emit(Event{Type: EventPieceReceived, Piece: index})
+		if index < next {
+			continue
+		}
+
+		m.lock.Lock()
+		for next < int(m.pieceCount) && m.pieces[next] != nil {
+			piece := m.pieces[next]
+			//已写出的piece置为空切片, 释放内存但仍视为已收到
+			m.pieces[next] = []byte{}
+			next++
+			m.lock.Unlock()
+
+			hash.Write(piece)
+			n, err := w.Write(piece)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+			m.lock.Lock()
+		}
+		buffered := 0
+		for _, piece := range m.pieces[next:] {
+			if piece != nil {
+				buffered++
+			}
+		}
+		m.lock.Unlock()
+
+		if m.maxBufferedPieces > 0 && buffered > m.maxBufferedPieces {
+			return written, ErrReorderBufferExceeded
+		}
+	}
+
+	if sum := hash.Sum(nil); !bytes.Equal(sum, m.infoHash) {
+		return written, &ChecksumMismatchError{Got: sum, Want: m.infoHash, Len: written, WantLen: m.metadataSize}
+	}
+	return written, nil
+}
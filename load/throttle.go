@@ -0,0 +1,65 @@
+package load
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// NewBandwidthLimiter 字节/秒的限速器, 可以通过WithSharedBandwidthLimiter在多个连接之间共享
+func NewBandwidthLimiter(bytesPerSec int) *rate.Limiter {
+	burst := bytesPerSec
+	if burst < minMessageSize {
+		burst = minMessageSize
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// throttledConn 读写前从所有limiter取得令牌, 等待期间ctx取消则返回错误
+type throttledConn struct {
+	net.Conn
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (c *throttledConn) wait(n int) error {
+	for _, l := range c.limiters {
+		left := n
+		for left > 0 {
+			chunk := left
+			if chunk > l.Burst() {
+				chunk = l.Burst()
+			}
+			if err := l.WaitN(c.ctx, chunk); err != nil {
+				return err
+			}
+			left -= chunk
+		}
+	}
+	return nil
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if werr := c.wait(n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	if err := c.wait(len(b)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (m *Meta) throttle(conn net.Conn) net.Conn {
+	if len(m.limiters) == 0 {
+		return conn
+	}
+	return &throttledConn{Conn: conn, ctx: m.ctx, limiters: m.limiters}
+}
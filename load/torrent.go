@@ -1,18 +1,26 @@
 package load
 
 import (
+	"DHTsimple/common"
 	"DHTsimple/config"
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
-
-	"github.com/marksamman/bencode"
+	"time"
 )
 
 type Tfile struct {
 	Name   string `json:"file_name"`
 	Length int64  `json:"file_len"`
+	//BEP 47填充文件, 只用于对齐piece, 不应展示给用户
+	Padding bool `json:"padding,omitempty"`
 }
 
 type Torrent struct {
@@ -22,6 +30,37 @@ type Torrent struct {
 	Files   []*Tfile `json:"files"`
 }
 
+// TotalSize 所有文件的总大小, 单文件时为length
+func (t *Torrent) TotalSize() int64 {
+	if len(t.Files) == 0 {
+		return t.Length
+	}
+	var total int64
+	for _, f := range t.Files {
+		total += f.Length
+	}
+	return total
+}
+
+// ContentSize 不包括填充文件的总大小
+func (t *Torrent) ContentSize() int64 {
+	total := t.TotalSize()
+	for _, f := range t.Files {
+		if f.Padding {
+			total -= f.Length
+		}
+	}
+	return total
+}
+
+// FileCount 文件数, 单文件torrent为1
+func (t *Torrent) FileCount() int {
+	if len(t.Files) == 0 {
+		return 1
+	}
+	return len(t.Files)
+}
+
 type HashPair struct {
 	Hash []byte
 	Addr string
@@ -29,20 +68,30 @@ type HashPair struct {
 
 var HashChan chan HashPair
 
+var MetaStore MetadataStore
+
 func init() {
 	HashChan = make(chan HashPair, config.Conf.LoadBufLen)
+	MetaStore = NewMemoryStore(config.Conf.MetaCacheLen)
 }
 
 func work() {
 	for {
 		select {
 		case info := <-HashChan:
-			d := NewMeta(info.Addr, info.Hash)
-			metaData := d.Load()
-			if metaData == nil {
+			if MetaStore.Has(info.Hash) {
+				continue
+			}
+			ret, err := FetchMetadata(context.Background(), info.Hash, []string{info.Addr}, fetchOptions()...)
+			if err != nil {
+				fmt.Printf("load err:%s\n", err.Error())
+				continue
+			}
+			if !VerifyInfoHash(ret.Data, info.Hash) {
+				fmt.Printf("metadata of %x checksum mismatch\n", info.Hash)
 				continue
 			}
-			t, err := parseTorrent(metaData, hex.EncodeToString(info.Hash))
+			t, err := parseTorrent(ret.Data, hex.EncodeToString(info.Hash))
 			if err != nil {
 				continue
 			}
@@ -51,18 +100,61 @@ func work() {
 	}
 }
 
+// fetchOptions 由配置文件生成的默认下载参数
+func fetchOptions() []Option {
+	var opts []Option
+	if config.Conf.ListenPort > 0 {
+		opts = append(opts, WithListenPort(config.Conf.ListenPort))
+	}
+	return opts
+}
+
 func LoadTorrent(n int) {
 	for i := 0; i < n; i++ {
 		go work()
 	}
 }
 
+// InfoHash 计算info字典的infohash
+// infoDict必须是原始的bencode字节, 不能是解码后重新编码的结果, 重新编码可能改变key的顺序从而改变hash
+func InfoHash(infoDict []byte) [20]byte {
+	return sha1.Sum(infoDict)
+}
+
+// VerifyInfoHash 重新计算raw的infohash并与want比较, 用于发现缓存或文件中被篡改/损坏的metadata
+func VerifyInfoHash(raw []byte, want []byte) bool {
+	sum := InfoHash(raw)
+	return bytes.Equal(sum[:], want)
+}
+
+// ParseInfoHash 解析40位hex或32位base32(magnet链接中的btih)形式的infohash, 不区分大小写
+func ParseInfoHash(s string) ([]byte, error) {
+	switch len(s) {
+	case 40:
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex infohash: %s", s)
+		}
+		return b, nil
+	case 32:
+		b, err := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base32 infohash: %s", s)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("infohash must be 40 hex or 32 base32 characters, got %d", len(s))
+}
+
 func parseTorrent(meta []byte, hashHex string) (*Torrent, error) {
-	dict, err := bencode.Decode(bytes.NewBuffer(meta))
+	dict, err := common.DecodeDict(meta)
 	if err != nil {
 		return nil, err
 	}
+	return parseInfo(dict, hashHex), nil
+}
 
+func parseInfo(dict map[string]interface{}, hashHex string) *Torrent {
 	t := &Torrent{HashHex: hashHex}
 	if name, ok := dict["name.utf-8"].(string); ok {
 		t.Name = name
@@ -94,7 +186,8 @@ func parseTorrent(meta []byte, hashHex string) (*Torrent, error) {
 			filelength = length
 			totalSize += filelength
 		}
-		t.Files = append(t.Files, &Tfile{Name: filename, Length: filelength})
+		attr, _ := file["attr"].(string)
+		t.Files = append(t.Files, &Tfile{Name: filename, Length: filelength, Padding: isPaddingFile(attr, filename)})
 	}
 
 	if files, ok := dict["files"].([]interface{}); ok {
@@ -112,5 +205,84 @@ func parseTorrent(meta []byte, hashHex string) (*Torrent, error) {
 		t.Files = append(t.Files, &Tfile{Name: t.Name, Length: t.Length})
 	}
 
-	return t, nil
+	return t
+}
+
+// isPaddingFile attr中含p(BEP 47), 或者是旧版客户端使用的_____padding_file开头的文件名
+func isPaddingFile(attr string, name string) bool {
+	if strings.Contains(attr, "p") {
+		return true
+	}
+	base := name[strings.LastIndex(name, "/")+1:]
+	return strings.HasPrefix(base, "_____padding")
+}
+
+// VerifyTorrentFile 检查保存的.torrent文件是否损坏: 取出原始info字节重新计算infohash,
+// info必须是有效的bencode字典; 文件名(去掉扩展名)是hex或base32的infohash时还要与之相同.
+// 文件无法读取, 不是有效的bencode或没有info字典时返回err, info内容损坏时返回ok为false
+func VerifyTorrentFile(path string) (hash []byte, ok bool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	info, err := common.RawDictValue(data, "info")
+	if err != nil {
+		return nil, false, fmt.Errorf("decode torrent %s: %w", path, err)
+	}
+	if info == nil {
+		return nil, false, errors.New("torrent has no info dict")
+	}
+	sum := InfoHash(info)
+	if _, err := common.DecodeDict(info); err != nil || info[0] != 'd' {
+		return sum[:], false, nil
+	}
+
+	name := filepath.Base(path)
+	if want, err := ParseInfoHash(strings.TrimSuffix(name, filepath.Ext(name))); err == nil {
+		return sum[:], bytes.Equal(sum[:], want), nil
+	}
+	return sum[:], true, nil
+}
+
+// TorrentMeta .torrent文件中info字典以及info之外的信息
+type TorrentMeta struct {
+	Info         *Torrent
+	CreationDate time.Time
+	CreatedBy    string
+	Comment      string
+}
+
+func DecodeTorrentFile(path string) (*TorrentMeta, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dict, err := common.DecodeDict(data)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := dict["info"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("torrent has no info dict")
+	}
+
+	//重新编码可能改变key的顺序和整数的写法, infohash必须用文件中的原始字节计算
+	raw, err := common.RawDictValue(data, "info")
+	if err != nil {
+		return nil, err
+	}
+	hash := InfoHash(raw)
+	tm := &TorrentMeta{Info: parseInfo(info, hex.EncodeToString(hash[:]))}
+	if date, ok := dict["creation date"].(int64); ok {
+		tm.CreationDate = time.Unix(date, 0)
+	}
+	if by, ok := dict["created by"].(string); ok {
+		tm.CreatedBy = by
+	}
+	if comment, ok := dict["comment.utf-8"].(string); ok {
+		tm.Comment = comment
+	} else if comment, ok := dict["comment"].(string); ok {
+		tm.Comment = comment
+	}
+	return tm, nil
 }
@@ -0,0 +1,101 @@
+package load
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/marksamman/bencode"
+)
+
+func TestParseInfoPaddingFiles(t *testing.T) {
+	file := func(length int, attr string, path ...interface{}) interface{} {
+		f := map[string]interface{}{"length": length, "path": path}
+		if attr != "" {
+			f["attr"] = attr
+		}
+		return f
+	}
+	info := bencode.Encode(map[string]interface{}{
+		"name": "album",
+		"files": []interface{}{
+			file(1000, "", "a.flac"),
+			//BEP 47, 可执行且填充
+			file(15384, "xp", ".pad", "15384"),
+			//旧版客户端的填充文件名
+			file(100, "", "_____padding_file_0_如果您看到此文件，请升级到BitComet(比特彗星)0.85或以上版本____"),
+			file(500, "x", "b.flac"),
+		},
+		"piece length": 16384,
+	})
+	tor, err := parseTorrent(info, "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []bool{false, true, true, false}
+	if len(tor.Files) != len(want) {
+		t.Fatalf("got %d files, want %d", len(tor.Files), len(want))
+	}
+	for i, f := range tor.Files {
+		if f.Padding != want[i] {
+			t.Errorf("%s padding = %v, want %v", f.Name, f.Padding, want[i])
+		}
+	}
+	if got := tor.TotalSize(); got != 16984 {
+		t.Errorf("TotalSize = %d, want 16984", got)
+	}
+	if got := tor.ContentSize(); got != 1500 {
+		t.Errorf("ContentSize = %d, want 1500", got)
+	}
+
+	//普通文件导出时不带padding字段
+	b, err := json.Marshal(tor.Files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "padding") {
+		t.Errorf("regular file exported as %s", b)
+	}
+}
+
+func TestVerifyTorrentFile(t *testing.T) {
+	info := testMetadata(200)
+	sum := InfoHash(info)
+	torrent := func(info []byte) []byte {
+		return append(append([]byte("d8:announce3:foo4:info"), info...), 'e')
+	}
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+		err  bool
+	}{
+		{"good.torrent", torrent(info), true, false},
+		{hex.EncodeToString(sum[:]) + ".torrent", torrent(info), true, false},
+		//文件名中的infohash与内容不同
+		{strings.Repeat("0", 40) + ".torrent", torrent(info), false, false},
+		//info不是字典
+		{"list.torrent", torrent([]byte("li1ee")), false, false},
+		{"truncated.torrent", torrent(info)[:100], false, true},
+		{"garbage.torrent", []byte("not bencode"), false, true},
+		{"noinfo.torrent", []byte("d8:announce3:fooe"), false, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := ioutil.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, ok, err := VerifyTorrentFile(path)
+		if ok != tt.ok || (err != nil) != tt.err {
+			t.Errorf("%s: ok=%v err=%v, want ok=%v err=%v", tt.name, ok, err, tt.ok, tt.err)
+		}
+	}
+	if _, _, err := VerifyTorrentFile(filepath.Join(dir, "missing.torrent")); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
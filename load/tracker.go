@@ -0,0 +1,331 @@
+package load
+
+import (
+	"DHTsimple/common"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	//一次announce的超时时间
+	trackerTimeout = 15 * time.Second
+	//希望tracker返回的peer数
+	trackerNumWant = 200
+	//http tracker响应的最大长度
+	maxTrackerResponse = 1 << 20
+
+	//udp announce的超时时间, 可以按BEP 15重发一次: 15s后重发, 再等30s
+	udpTrackerTimeout = 45 * time.Second
+	//BEP 15中n的上限
+	udpMaxRetries = 8
+
+	//BEP 15
+	udpTrackerMagic   = 0x41727101980
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionError    = 3
+)
+
+var trackerClient = &http.Client{Timeout: trackerTimeout}
+
+// udpRetryBase BEP 15的重发间隔为udpRetryBase*2^n, 测试时缩短
+var udpRetryBase = 15 * time.Second
+
+// AnnounceHTTP 向http(s) tracker发送announce, 返回的peer地址可以直接交给FetchMetadata
+// User-Agent使用SetFingerprint设置的客户端身份, peerID通常由同一身份生成, 见FingerprintPeerID
+// ctx结束或超过trackerTimeout时放弃请求
+func AnnounceHTTP(ctx context.Context, trackerURL string, infoHash [20]byte, peerID string, port int) ([]string, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, err
+	}
+	//info_hash和peer_id是原始字节, 需要逐字节转义
+	query := u.RawQuery
+	if query != "" {
+		query += "&"
+	}
+	query += "info_hash=" + url.QueryEscape(string(infoHash[:])) +
+		"&peer_id=" + url.QueryEscape(peerID) +
+		"&port=" + strconv.Itoa(port) +
+		"&uploaded=0&downloaded=0&left=0&compact=1&event=started" +
+		"&numwant=" + strconv.Itoa(trackerNumWant)
+	u.RawQuery = query
+
+	ctx, cancel := context.WithTimeout(ctx, trackerTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if ua := currentFingerprint().UserAgent; ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
+	resp, err := trackerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker %s status %d", trackerURL, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxTrackerResponse))
+	if err != nil {
+		return nil, err
+	}
+	dict, err := common.DecodeDict(body)
+	if err != nil {
+		return nil, err
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, fmt.Errorf("tracker %s failure: %s", trackerURL, reason)
+	}
+
+	var peers []string
+	switch v := dict["peers"].(type) {
+	case string:
+		peers, err = decodePeers([]byte(v), false)
+		if err != nil {
+			return nil, err
+		}
+	case []interface{}:
+		//不支持compact的tracker返回字典列表
+		for _, p := range v {
+			peer, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ip, _ := peer["ip"].(string)
+			port, _ := peer["port"].(int64)
+			if ip == "" || port <= 0 || port > 65535 {
+				continue
+			}
+			peers = append(peers, net.JoinHostPort(ip, strconv.Itoa(int(port))))
+		}
+	}
+	if v, ok := dict["peers6"].(string); ok {
+		list, err := decodePeers([]byte(v), true)
+		if err == nil {
+			peers = append(peers, list...)
+		}
+	}
+	return peers, nil
+}
+
+// AnnounceUDP 按BEP 15向udp tracker发送announce, trackerURL形如udp://host:port/announce
+// 没有响应时按BEP 15的间隔重发, ctx结束或超过udpTrackerTimeout时放弃
+func AnnounceUDP(ctx context.Context, trackerURL string, infoHash [20]byte, peerID string, port int) ([]string, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" {
+		return nil, fmt.Errorf("not an udp tracker: %s", trackerURL)
+	}
+	ctx, cancel := context.WithTimeout(ctx, udpTrackerTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	//ctx在deadline之前被取消时关闭连接, 让读写立即返回
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	peers, err := udpAnnounce(conn, deadline, infoHash, peerID, port)
+	if err != nil {
+		//连接的deadline就是ctx的deadline, 读写超时时ctx也随即结束
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			<-ctx.Done()
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return peers, err
+}
+
+// udpAnnounce 在conn上完成BEP 15的connect和announce, deadline之后不再重发
+func udpAnnounce(conn net.Conn, deadline time.Time, infoHash [20]byte, peerID string, port int) ([]string, error) {
+	//connect
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:], udpTrackerMagic)
+	binary.BigEndian.PutUint32(req[8:], udpActionConnect)
+	tid := udpTransactionId()
+	binary.BigEndian.PutUint32(req[12:], tid)
+	resp, err := udpTrackerRoundTrip(conn, deadline, req, udpActionConnect, tid, 16)
+	if err != nil {
+		return nil, err
+	}
+	connectionId := binary.BigEndian.Uint64(resp[8:16])
+
+	//announce
+	req = make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:], connectionId)
+	binary.BigEndian.PutUint32(req[8:], udpActionAnnounce)
+	tid = udpTransactionId()
+	binary.BigEndian.PutUint32(req[12:], tid)
+	copy(req[16:36], infoHash[:])
+	copy(req[36:56], peerID)
+	//downloaded, left, uploaded为0, event为started
+	binary.BigEndian.PutUint32(req[80:], 2)
+	binary.BigEndian.PutUint32(req[88:], udpTransactionId())
+	binary.BigEndian.PutUint32(req[92:], trackerNumWant)
+	binary.BigEndian.PutUint16(req[96:], uint16(port))
+	resp, err = udpTrackerRoundTrip(conn, deadline, req, udpActionAnnounce, tid, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	//ipv6 tracker返回18字节的peer
+	ipv6 := false
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+	return decodePeers(resp[20:], ipv6)
+}
+
+// udpTrackerRoundTrip 发送req并读取action和transaction id对应的响应, 响应至少minLen字节
+// 第n次发送后等待udpRetryBase*2^n, 没有响应时重发, 最后一次等到deadline
+func udpTrackerRoundTrip(conn net.Conn, deadline time.Time, req []byte, action uint32, tid uint32, minLen int) ([]byte, error) {
+	base := udpRetryBase
+	buf := make([]byte, 2048)
+	for n := 0; ; n++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		try := time.Now().Add(base << uint(n))
+		last := n >= udpMaxRetries || !try.Before(deadline)
+		if last {
+			try = deadline
+		}
+		conn.SetReadDeadline(try)
+		resp, err := udpTrackerRead(conn, buf, action, tid, minLen)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && !last {
+			continue
+		}
+		return resp, err
+	}
+}
+
+// udpTrackerRead 读取transaction id为tid的响应, 忽略其它数据包(之前请求的迟到响应等)
+func udpTrackerRead(conn net.Conn, buf []byte, action uint32, tid uint32, minLen int) ([]byte, error) {
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := buf[:n]
+		if len(resp) < 8 || binary.BigEndian.Uint32(resp[4:8]) != tid {
+			continue
+		}
+		switch binary.BigEndian.Uint32(resp[0:4]) {
+		case action:
+		case udpActionError:
+			return nil, fmt.Errorf("udp tracker error: %s", bytes.TrimRight(resp[8:], "\x00"))
+		default:
+			return nil, errors.New("udp tracker unexpected action")
+		}
+		if len(resp) < minLen {
+			return nil, errors.New("udp tracker response too short")
+		}
+		return resp, nil
+	}
+}
+
+func udpTransactionId() uint32 {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
+
+// Announce 根据trackerURL的scheme选择http或udp tracker
+func Announce(ctx context.Context, trackerURL string, infoHash [20]byte, peerID string, port int) ([]string, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return AnnounceHTTP(ctx, trackerURL, infoHash, peerID, port)
+	case "udp":
+		return AnnounceUDP(ctx, trackerURL, infoHash, peerID, port)
+	}
+	return nil, fmt.Errorf("unsupported tracker scheme: %s", u.Scheme)
+}
+
+type announceResult struct {
+	tracker string
+	peers   []string
+	err     error
+}
+
+// AnnounceAll 同时向所有tracker announce, 合并去重返回的peer
+// 得到want个peer(want<=0时不限)、所有tracker都已返回或ctx结束时返回已得到的peer,
+// 每个tracker单独超时, 慢的tracker不会拖住其它tracker, 返回时取消还没有完成的announce.
+// 没有得到任何peer时返回最后一个错误
+func AnnounceAll(ctx context.Context, trackers []string, infoHash [20]byte, peerID string, port int, want int) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan announceResult, len(trackers))
+	for _, tracker := range trackers {
+		go func(tracker string) {
+			peers, err := Announce(ctx, tracker, infoHash, peerID, port)
+			results <- announceResult{tracker: tracker, peers: peers, err: err}
+		}(tracker)
+	}
+
+	var peers []string
+	seen := make(map[string]bool)
+	err := ErrNoPeers
+	for i := 0; i < len(trackers); i++ {
+		select {
+		case <-ctx.Done():
+			if len(peers) == 0 {
+				return nil, ctx.Err()
+			}
+			return peers, nil
+		case r := <-results:
+			if r.err != nil {
+				fmt.Printf("announce to %s err:%s\n", r.tracker, r.err.Error())
+				err = r.err
+				continue
+			}
+			for _, p := range r.peers {
+				if !seen[p] {
+					seen[p] = true
+					peers = append(peers, p)
+				}
+			}
+		}
+		if want > 0 && len(peers) >= want {
+			break
+		}
+	}
+	if len(peers) == 0 {
+		return nil, err
+	}
+	return peers, nil
+}
@@ -0,0 +1,156 @@
+package load
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// udpTracker 按BEP 15回复connect和announce的tracker
+type udpTracker struct {
+	//announce返回的compact格式peer
+	peers []byte
+	//不回复任何请求
+	silent bool
+	//不回复前drop个请求, 模拟丢包
+	drop int
+	//回复前先发送一个transaction id不同的数据包
+	stray bool
+	//收到的请求数
+	requests int32
+}
+
+func startUDPTracker(t *testing.T, tr *udpTracker) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if atomic.AddInt32(&tr.requests, 1) <= int32(tr.drop) || tr.silent || n < 16 {
+				continue
+			}
+			action := binary.BigEndian.Uint32(buf[8:12])
+			resp := make([]byte, 8, 20+len(tr.peers))
+			binary.BigEndian.PutUint32(resp[0:], action)
+			copy(resp[4:8], buf[12:16])
+			if tr.stray {
+				stray := append([]byte(nil), resp...)
+				stray[7] ^= 0xff
+				conn.WriteTo(append(stray, "strayxxxstrayxxx"...), addr)
+			}
+			if action == udpActionConnect {
+				resp = append(resp, "connid00"...)
+			} else {
+				//interval, leechers, seeders
+				resp = append(resp, make([]byte, 12)...)
+				resp = append(resp, tr.peers...)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return "udp://" + conn.LocalAddr().String() + "/announce"
+}
+
+func TestAnnounceUDP(t *testing.T) {
+	tracker := startUDPTracker(t, &udpTracker{peers: []byte{10, 0, 0, 1, 0x1a, 0xe1}})
+	peers, err := AnnounceUDP(context.Background(), tracker, [20]byte{1}, "-DS0001-000000000000", 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0] != "10.0.0.1:6881" {
+		t.Fatalf("peers %v", peers)
+	}
+}
+
+func TestAnnounceUDPHonorsContext(t *testing.T) {
+	tracker := startUDPTracker(t, &udpTracker{silent: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := AnnounceUDP(ctx, tracker, [20]byte{1}, "-DS0001-000000000000", 6881)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err %v, want deadline exceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("returned after %s", d)
+	}
+}
+
+// transaction id不同的数据包被忽略, 丢失的请求按BEP 15重发
+func TestAnnounceUDPRetransmit(t *testing.T) {
+	base := udpRetryBase
+	udpRetryBase = 50 * time.Millisecond
+	t.Cleanup(func() { udpRetryBase = base })
+
+	tests := []struct {
+		name     string
+		tracker  *udpTracker
+		requests int32
+	}{
+		{"stray datagram", &udpTracker{stray: true}, 2},
+		//connect请求丢失两次, 第三次才有响应
+		{"dropped requests", &udpTracker{drop: 2}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.tracker.peers = []byte{10, 0, 0, 1, 0x1a, 0xe1}
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			peers, err := AnnounceUDP(ctx, startUDPTracker(t, tt.tracker), [20]byte{1}, "-DS0001-000000000000", 6881)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(peers) != 1 || peers[0] != "10.0.0.1:6881" {
+				t.Fatalf("peers %v", peers)
+			}
+			if n := atomic.LoadInt32(&tt.tracker.requests); n != tt.requests {
+				t.Fatalf("tracker got %d requests, want %d", n, tt.requests)
+			}
+		})
+	}
+}
+
+// tracker一直不响应, ctx取消后TrackerSource应该立即关闭channel
+func TestTrackerSourceHonorsContext(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	for _, url := range []string{srv.URL + "/announce", startUDPTracker(t, &udpTracker{silent: true})} {
+		ctx, cancel := context.WithCancel(context.Background())
+		ch, err := TrackerSource{URL: url}.Peers(ctx, [20]byte{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.AfterFunc(50*time.Millisecond, cancel)
+		select {
+		case _, ok := <-ch:
+			if ok {
+				t.Fatalf("%s: got a peer", url)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: announce not cancelled", url)
+		}
+		cancel()
+	}
+}
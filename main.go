@@ -1,14 +1,19 @@
 package main
 
 import (
+	"DHTsimple/config"
 	"DHTsimple/dht"
 	"DHTsimple/load"
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 	d := dht.NewDHT()
 	err := d.Start()
@@ -20,8 +25,29 @@ func main() {
 
 	go load.LoadTorrent(2)
 
+	var server *load.Server
+	if config.Conf.ListenPort > 0 {
+		server = load.NewServer(fmt.Sprintf(":%d", config.Conf.ListenPort), load.MetaStore)
+		go func() {
+			err := server.ListenAndServe()
+			if err != nil && err != load.ErrServerClosed {
+				fmt.Println("bt server err:", err.Error())
+			}
+		}()
+	}
+
 	s := make(chan os.Signal, 1)
 	signal.Notify(s, os.Interrupt, os.Kill, syscall.SIGTERM)
 	<-s
+
+	//等待goroutine退出并保存路由表, 最多等待shutdownTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if server != nil {
+		server.Close()
+	}
+	if err := d.Close(ctx); err != nil {
+		fmt.Println("close dht err:", err.Error())
+	}
 	fmt.Println("over")
 }